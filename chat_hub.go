@@ -0,0 +1,145 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Chat hub
+const (
+	chatRoleUser    = "user"
+	chatRoleSupport = "admin"
+	// chatSendBuffer messages wait for a slow connection before it is dropped.
+	chatSendBuffer = 32
+)
+
+var chatWriteTimeout = 10 * time.Second
+
+// chatConn is one websocket of a chat room, only its write goroutine writes to it.
+type chatConn struct {
+	conn   *websocket.Conn
+	chatID string
+	role   string
+	send   chan []byte
+}
+
+// chatRoom holds the connections of one chat, the client may have several
+// tabs open and a chat is handled by one support agent at a time.
+type chatRoom struct {
+	client  map[*chatConn]bool
+	support map[*chatConn]bool
+}
+
+// chatHub routes messages between the connections of the same chat _id.
+type chatHub struct {
+	mu    sync.Mutex
+	rooms map[string]*chatRoom
+}
+
+var chatRooms = &chatHub{rooms: map[string]*chatRoom{}}
+
+func newChatConn(conn *websocket.Conn, chatID string, role string) *chatConn {
+	return &chatConn{conn: conn, chatID: chatID, role: role, send: make(chan []byte, chatSendBuffer)}
+}
+
+// writeLoop writes the queued messages until the connection leaves the hub.
+func (c *chatConn) writeLoop() {
+	defer c.conn.Close()
+	for msg := range c.send {
+		c.conn.SetWriteDeadline(time.Now().Add(chatWriteTimeout))
+		if err := c.conn.WriteMessage(websocket.TextMessage, msg); err != nil {
+			return
+		}
+	}
+	c.conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+}
+
+// join adds the connection to its room and starts its write goroutine.
+func (h *chatHub) join(c *chatConn) {
+	h.mu.Lock()
+	room, ok := h.rooms[c.chatID]
+	if !ok {
+		room = &chatRoom{client: map[*chatConn]bool{}, support: map[*chatConn]bool{}}
+		h.rooms[c.chatID] = room
+	}
+	room.side(c.role)[c] = true
+	h.mu.Unlock()
+	go c.writeLoop()
+}
+
+// leave removes the connection and stops its write goroutine, it is safe to call twice.
+func (h *chatHub) leave(c *chatConn) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.drop(c)
+}
+
+// drop must be called with h.mu held.
+func (h *chatHub) drop(c *chatConn) {
+	room, ok := h.rooms[c.chatID]
+	if !ok || !room.side(c.role)[c] {
+		return
+	}
+	delete(room.side(c.role), c)
+	close(c.send)
+	if len(room.client) == 0 && len(room.support) == 0 {
+		delete(h.rooms, c.chatID)
+	}
+}
+func (room *chatRoom) side(role string) map[*chatConn]bool {
+	if role == chatRoleSupport {
+		return room.support
+	}
+	return room.client
+}
+
+// deliver queues the message to the connections of the role in the chat, a
+// connection too slow to keep up is dropped instead of blocking the room.
+func (h *chatHub) deliver(chatID string, role string, msg []byte) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	room, ok := h.rooms[chatID]
+	if !ok {
+		return
+	}
+	for c := range room.side(role) {
+		select {
+		case c.send <- msg:
+		default:
+			h.drop(c)
+		}
+	}
+}
+
+// forward sends a message of one side of the chat to the other side.
+func (h *chatHub) forward(from *chatConn, msg []byte) {
+	to := chatRoleSupport
+	if from.role == chatRoleSupport {
+		to = chatRoleUser
+	}
+	h.deliver(from.chatID, to, msg)
+}
+func (h *chatHub) connections(chatID string, role string) int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	room, ok := h.rooms[chatID]
+	if !ok {
+		return 0
+	}
+	return len(room.side(role))
+}
+
+// kick disconnects the role from the chat, an agent losing the chat can not write to it any more.
+func (h *chatHub) kick(chatID string, role string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	room, ok := h.rooms[chatID]
+	if !ok {
+		return
+	}
+	for c := range room.side(role) {
+		h.drop(c)
+	}
+}
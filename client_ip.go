@@ -0,0 +1,71 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"net/netip"
+	"os"
+	"strings"
+)
+
+// Client address
+// trustedProxies are the addresses or CIDRs of TRUSTED_PROXIES, comma separated.
+// X-Forwarded-For is only read from them, invalid entries are skipped.
+var trustedProxies = parseTrustedProxies(os.Getenv("TRUSTED_PROXIES"))
+
+func parseTrustedProxies(list string) []netip.Prefix {
+	var proxies []netip.Prefix
+	for _, entry := range strings.Split(list, ",") {
+		entry = strings.TrimSpace(entry)
+		if prefix, err := netip.ParsePrefix(entry); err == nil {
+			proxies = append(proxies, prefix.Masked())
+		} else if addr, err := netip.ParseAddr(entry); err == nil {
+			proxies = append(proxies, netip.PrefixFrom(addr.Unmap(), addr.Unmap().BitLen()))
+		}
+	}
+	return proxies
+}
+func isTrustedProxy(proxies []netip.Prefix, ip string) bool {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return false
+	}
+	for _, proxy := range proxies {
+		if proxy.Contains(addr.Unmap()) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientIP is the address the request came from. Behind trusted proxies it is the
+// right-most X-Forwarded-For hop that is not a proxy, the hops left of it are
+// written by the client and can be anything.
+func clientIP(r *http.Request) string {
+	return forwardedClientIP(r, trustedProxies)
+}
+func forwardedClientIP(r *http.Request, proxies []netip.Prefix) string {
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		ip = r.RemoteAddr
+	}
+	if !isTrustedProxy(proxies, ip) {
+		return ip
+	}
+	var hops []string
+	for _, header := range r.Header.Values("X-Forwarded-For") {
+		hops = append(hops, strings.Split(header, ",")...)
+	}
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := strings.TrimSpace(hops[i])
+		if _, err := netip.ParseAddr(hop); err != nil {
+			// a malformed hop can not be trusted, keep the last proxy seen
+			return ip
+		}
+		ip = hop
+		if !isTrustedProxy(proxies, ip) {
+			return ip
+		}
+	}
+	return ip
+}
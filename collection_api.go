@@ -0,0 +1,229 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// Collection API
+type CollectionCard struct {
+	Card  `bson:",inline"`
+	Count int `json:"count"`
+}
+type FacetCount struct {
+	Value string `bson:"_id" json:"value"`
+	Count int    `json:"count"`
+}
+type collectionQuery struct {
+	Search      string
+	Position    string
+	Club        string
+	Nationality string
+	Rarity      string
+	Sort        string
+	Order       int
+	Group       bool
+	Page        int
+	PerPage     int
+}
+
+const defaultPerPage = 20
+const maxPerPage = 100
+
+var collectionSortKeys = map[string]string{
+	"name":        "name",
+	"card_id":     "card_id",
+	"club":        "club",
+	"nationality": "nationality",
+	"position":    "position",
+	"rarity":      "rarity_rank",
+	"count":       "count",
+}
+var collectionFacets = []string{"position", "club", "nationality", "rarity"}
+
+// parsePage reads page and per_page, per_page is capped at maxPerPage.
+func parsePage(values url.Values) (int, int, error) {
+	page, perPage := 1, defaultPerPage
+	if value := values.Get("page"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 1 {
+			return 0, 0, errors.New("invalid page")
+		}
+		page = n
+	}
+	if value := values.Get("per_page"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 1 {
+			return 0, 0, errors.New("invalid per_page")
+		}
+		perPage = n
+	}
+	if perPage > maxPerPage {
+		perPage = maxPerPage
+	}
+	return page, perPage, nil
+}
+func parseOrder(values url.Values) (int, error) {
+	switch values.Get("order") {
+	case "", "asc":
+		return 1, nil
+	case "desc":
+		return -1, nil
+	}
+	return 0, errors.New("order must be asc or desc")
+}
+func parseCollectionQuery(values url.Values) (collectionQuery, error) {
+	query := collectionQuery{
+		Search:      values.Get("q"),
+		Position:    values.Get("position"),
+		Club:        values.Get("club"),
+		Nationality: values.Get("nationality"),
+		Rarity:      values.Get("rarity"),
+		Sort:        values.Get("sort"),
+		Group:       values.Get("group") == "true",
+	}
+	if query.Sort == "" {
+		query.Sort = "card_id"
+	}
+	if _, ok := collectionSortKeys[query.Sort]; !ok {
+		return query, errors.New("invalid sort key " + query.Sort)
+	}
+	if query.Sort == "count" && !query.Group {
+		return query, errors.New("sort by count needs group=true")
+	}
+	order, err := parseOrder(values)
+	if err != nil {
+		return query, err
+	}
+	query.Order = order
+	if query.Rarity != "" && !validRarity(query.Rarity) {
+		return query, errors.New("invalid rarity " + query.Rarity)
+	}
+	query.Page, query.PerPage, err = parsePage(values)
+	if err != nil {
+		return query, err
+	}
+	return query, nil
+}
+
+// collectionPipeline unwinds the users collection into single cards and
+// returns the requested page, the total and the facet counts in one document.
+func collectionPipeline(userID string, query collectionQuery) mongo.Pipeline {
+	filter := bson.M{}
+	if query.Search != "" {
+		filter["name"] = bson.M{"$regex": regexp.QuoteMeta(query.Search), "$options": "i"}
+	}
+	if query.Position != "" {
+		filter["position"] = query.Position
+	}
+	if query.Club != "" {
+		filter["club"] = query.Club
+	}
+	if query.Nationality != "" {
+		filter["nationality"] = query.Nationality
+	}
+	if query.Rarity != "" {
+		filter["rarity"] = rarityFilter(query.Rarity)["rarity"]
+	}
+	pipeline := mongo.Pipeline{
+		{{Key: "$match", Value: bson.M{"user_id": userID}}},
+		{{Key: "$unwind", Value: "$card_id"}},
+		{{Key: "$replaceRoot", Value: bson.M{"newRoot": "$card_id"}}},
+		{{Key: "$addFields", Value: bson.M{"rarity": bson.M{"$ifNull": bson.A{"$rarity", "common"}}}}},
+		{{Key: "$match", Value: filter}},
+	}
+	if query.Group {
+		pipeline = append(pipeline,
+			bson.D{{Key: "$group", Value: bson.M{
+				"_id":   "$card_id",
+				"card":  bson.M{"$first": "$$ROOT"},
+				"count": bson.M{"$sum": 1},
+			}}},
+			bson.D{{Key: "$replaceRoot", Value: bson.M{"newRoot": bson.M{"$mergeObjects": bson.A{"$card", bson.M{"count": "$count"}}}}}},
+		)
+	} else {
+		pipeline = append(pipeline, bson.D{{Key: "$addFields", Value: bson.M{"count": 1}}})
+	}
+	pipeline = append(pipeline, bson.D{{Key: "$addFields", Value: bson.M{
+		"rarity_rank": bson.M{"$indexOfArray": bson.A{rarities, "$rarity"}},
+	}}})
+	sort := bson.D{{Key: collectionSortKeys[query.Sort], Value: query.Order}}
+	if query.Sort != "card_id" {
+		sort = append(sort, bson.E{Key: "card_id", Value: 1})
+	}
+	facets := bson.M{
+		"items": bson.A{
+			bson.M{"$sort": sort},
+			bson.M{"$skip": (query.Page - 1) * query.PerPage},
+			bson.M{"$limit": query.PerPage},
+		},
+		"total": bson.A{
+			bson.M{"$count": "total"},
+		},
+	}
+	for _, facet := range collectionFacets {
+		facets[facet] = bson.A{
+			bson.M{"$group": bson.M{"_id": "$" + facet, "count": bson.M{"$sum": 1}}},
+			bson.M{"$sort": bson.D{{Key: "count", Value: -1}, {Key: "_id", Value: 1}}},
+		}
+	}
+	return append(pipeline, bson.D{{Key: "$facet", Value: facets}})
+}
+func collectionCards(w http.ResponseWriter, r *http.Request) {
+	userID, err := actingUserID(r, "user_id")
+	if err != nil {
+		sendForbidden(w, "collectionCards", err)
+		return
+	}
+	query, err := parseCollectionQuery(r.URL.Query())
+	if err != nil {
+		sendErrorMessage(w, "collectionCards", err, "Invalid query: "+err.Error()+".")
+		return
+	}
+	cursor, err := db.Collection("collections").Aggregate(r.Context(), collectionPipeline(userID, query))
+	if err != nil {
+		sendErrorMessage(w, "collectionCards", err, "Error querying your collection. Try to reload page.")
+		return
+	}
+	var results []struct {
+		Items       []CollectionCard      `bson:"items"`
+		Total       []struct{ Total int } `bson:"total"`
+		Position    []FacetCount          `bson:"position"`
+		Club        []FacetCount          `bson:"club"`
+		Nationality []FacetCount          `bson:"nationality"`
+		Rarity      []FacetCount          `bson:"rarity"`
+	}
+	if err := cursor.All(r.Context(), &results); err != nil {
+		sendErrorMessage(w, "collectionCards", err, "Error decoding your collection. Try to reload page.")
+		return
+	}
+	items := []CollectionCard{}
+	total := 0
+	facets := map[string][]FacetCount{}
+	if len(results) > 0 {
+		if results[0].Items != nil {
+			items = results[0].Items
+		}
+		if len(results[0].Total) > 0 {
+			total = results[0].Total[0].Total
+		}
+		facets["position"] = results[0].Position
+		facets["club"] = results[0].Club
+		facets["nationality"] = results[0].Nationality
+		facets["rarity"] = results[0].Rarity
+	}
+	respondWithJSON(w, http.StatusOK, map[string]interface{}{
+		"status":   "success",
+		"items":    items,
+		"total":    total,
+		"page":     query.Page,
+		"per_page": query.PerPage,
+		"facets":   facets,
+	})
+}
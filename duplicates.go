@@ -0,0 +1,234 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sort"
+	"strconv"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// Rarity
+var rarities = []string{"common", "rare", "epic", "legendary"}
+var quickSellPrices = map[string]int{
+	"common":    10,
+	"rare":      40,
+	"epic":      150,
+	"legendary": 500,
+}
+
+// craftCost is the number of duplicates combined into one card of the next rarity.
+const craftCost = 5
+
+var errNotEnoughDuplicates = errors.New("not enough duplicates")
+
+func cardRarity(card Card) string {
+	if card.Rarity == "" {
+		return "common"
+	}
+	return card.Rarity
+}
+func validRarity(rarity string) bool {
+	for _, r := range rarities {
+		if r == rarity {
+			return true
+		}
+	}
+	return false
+}
+func nextRarity(rarity string) (string, bool) {
+	for i, r := range rarities {
+		if r == rarity && i+1 < len(rarities) {
+			return rarities[i+1], true
+		}
+	}
+	return "", false
+}
+
+// Duplicates
+type Duplicate struct {
+	Card  Card `json:"card"`
+	Count int  `json:"count"`
+	// Spare is the number of copies that can be sold or crafted, one copy always stays in the collection.
+	Spare int `json:"spare"`
+}
+
+func findDuplicates(cards []Card) []Duplicate {
+	counts := countCards(cards)
+	seen := make(map[int]bool)
+	var duplicates []Duplicate
+	for _, card := range cards {
+		if counts[card.Card_id] < 2 || seen[card.Card_id] {
+			continue
+		}
+		seen[card.Card_id] = true
+		duplicates = append(duplicates, Duplicate{
+			Card:  card,
+			Count: counts[card.Card_id],
+			Spare: counts[card.Card_id] - 1,
+		})
+	}
+	sort.Slice(duplicates, func(i, j int) bool {
+		return duplicates[i].Card.Card_id < duplicates[j].Card.Card_id
+	})
+	return duplicates
+}
+
+// takeSpareCards is takeCards that refuses to remove the last copy of a card.
+func takeSpareCards(cards []Card, want map[int]int) ([]Card, error) {
+	counts := countCards(cards)
+	for id, n := range want {
+		if counts[id]-n < 1 {
+			return nil, errNotEnoughDuplicates
+		}
+	}
+	return takeCards(cards, want)
+}
+func duplicates(w http.ResponseWriter, r *http.Request) {
+	userID, err := actingUserID(r, "user_id")
+	if err != nil {
+		sendForbidden(w, "duplicates", err)
+		return
+	}
+	collection, err := getUserCollection(r.Context(), userID)
+	if err != nil {
+		sendErrorMessage(w, "duplicates", err, "Error getting your collection. Try to reload page.")
+		return
+	}
+	respondWithJSON(w, http.StatusOK, map[string]interface{}{
+		"status":     "success",
+		"duplicates": findDuplicates(collection.Card_id),
+	})
+}
+func quickSell(w http.ResponseWriter, r *http.Request) {
+	userID, err := actingUserID(r, "user_id")
+	if err != nil {
+		sendForbidden(w, "quickSell", err)
+		return
+	}
+	cardID, err := strconv.Atoi(r.URL.Query().Get("card_id"))
+	if err != nil {
+		sendErrorMessage(w, "quickSell", err, "Invalid card_id parameter. Try again.")
+		return
+	}
+	count := 1
+	if value := r.URL.Query().Get("count"); value != "" {
+		count, err = strconv.Atoi(value)
+		if err != nil || count < 1 {
+			sendErrorMessage(w, "quickSell", errors.New("invalid input"), "Invalid count parameter. Try again.")
+			return
+		}
+	}
+	var coins int
+	err = withTransaction(r.Context(), func(sc mongo.SessionContext) error {
+		collection, err := getUserCollection(sc, userID)
+		if err != nil {
+			return err
+		}
+		rest, err := takeSpareCards(collection.Card_id, map[int]int{cardID: count})
+		if err != nil {
+			return err
+		}
+		var card Card
+		for _, c := range collection.Card_id {
+			if c.Card_id == cardID {
+				card = c
+				break
+			}
+		}
+		_, err = db.Collection("collections").UpdateOne(sc, bson.M{"user_id": userID}, bson.M{"$set": bson.M{"card_id": rest}})
+		if err != nil {
+			return err
+		}
+		coins = quickSellPrices[cardRarity(card)] * count
+		return changeCoins(sc, userID, coins, "quick_sell:"+strconv.Itoa(cardID))
+	})
+	if err == errNotEnoughDuplicates {
+		sendErrorMessage(w, "quickSell", err, "You do not have enough duplicates of this card.")
+		return
+	}
+	if err != nil {
+		sendErrorMessage(w, "quickSell", err, "Error selling duplicates. Try again.")
+		return
+	}
+	sendSuccessMessage(w, "quickSell", "Duplicates sold for "+strconv.Itoa(coins)+" coins.", "")
+}
+func craftCards(w http.ResponseWriter, r *http.Request) {
+	userID, err := actingUserID(r, "user_id")
+	if err != nil {
+		sendForbidden(w, "craftCards", err)
+		return
+	}
+	var data struct {
+		Card_ids []int `json:"card_ids"`
+	}
+	err = json.NewDecoder(r.Body).Decode(&data)
+	if err != nil {
+		sendErrorMessage(w, "craftCards", err, "Error decoding crafting data. Try again.")
+		return
+	}
+	if len(data.Card_ids) != craftCost {
+		sendErrorMessage(w, "craftCards", errors.New("invalid input"), "Crafting needs exactly "+strconv.Itoa(craftCost)+" duplicates.")
+		return
+	}
+	want := make(map[int]int)
+	for _, id := range data.Card_ids {
+		want[id]++
+	}
+	var crafted Card
+	err = withTransaction(r.Context(), func(sc mongo.SessionContext) error {
+		collection, err := getUserCollection(sc, userID)
+		if err != nil {
+			return err
+		}
+		rest, err := takeSpareCards(collection.Card_id, want)
+		if err != nil {
+			return err
+		}
+		rarity := ""
+		for _, card := range collection.Card_id {
+			if want[card.Card_id] == 0 {
+				continue
+			}
+			if rarity == "" {
+				rarity = cardRarity(card)
+			} else if rarity != cardRarity(card) {
+				return errors.New("crafted cards must have the same rarity")
+			}
+		}
+		next, ok := nextRarity(rarity)
+		if !ok {
+			return errors.New("cards of rarity " + rarity + " can not be crafted")
+		}
+		cursor, err := db.Collection("cards").Aggregate(sc, mongo.Pipeline{
+			{{Key: "$match", Value: bson.M{"rarity": next}}},
+			{{Key: "$sample", Value: bson.M{"size": 1}}},
+			{{Key: "$project", Value: bson.M{"_id": 0}}},
+		})
+		if err != nil {
+			return err
+		}
+		var cards []Card
+		if err := cursor.All(sc, &cards); err != nil {
+			return err
+		}
+		if len(cards) == 0 {
+			return errors.New("there are no " + next + " cards yet")
+		}
+		crafted = cards[0]
+		_, err = db.Collection("collections").UpdateOne(sc, bson.M{"user_id": userID}, bson.M{"$set": bson.M{"card_id": append(rest, crafted)}})
+		return err
+	})
+	if err == errNotEnoughDuplicates {
+		sendErrorMessage(w, "craftCards", err, "You do not have enough duplicates of these cards.")
+		return
+	}
+	if err != nil {
+		sendErrorMessage(w, "craftCards", err, "Error crafting card: "+err.Error()+". Try again.")
+		return
+	}
+	sendSuccessMessage(w, "craftCards", "The card "+crafted.Name+" ("+cardRarity(crafted)+") was crafted and added to your collection.", "")
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	htmltemplate "html/template"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"sync"
+	texttemplate "text/template"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// Email templates
+const defaultLanguage = "ru"
+
+var languages = []string{"ru", "kk", "en"}
+
+// emailNames are the templates every language file defines as <name>.subject, <name>.text and <name>.html.
+var emailNames = []string{"verification", "password_reset", "new_card", "price_alert", "listing_expired", "receipt"}
+
+var errUnknownEmail = errors.New("unknown email template")
+var errUnknownLanguage = errors.New("unknown language")
+
+type emailTemplateSet struct {
+	text *texttemplate.Template
+	html *htmltemplate.Template
+}
+
+// emailTemplates parses emails/<language>.tmpl once. The same file is parsed
+// as text for the subject and text part and as html for the html part.
+var emailTemplates = sync.OnceValues(func() (map[string]emailTemplateSet, error) {
+	return loadEmailTemplates("emails")
+})
+
+func loadEmailTemplates(dir string) (map[string]emailTemplateSet, error) {
+	sets := map[string]emailTemplateSet{}
+	for _, language := range languages {
+		path := filepath.Join(dir, language+".tmpl")
+		text, err := texttemplate.ParseFiles(path)
+		if err != nil {
+			return nil, err
+		}
+		html, err := htmltemplate.ParseFiles(path)
+		if err != nil {
+			return nil, err
+		}
+		sets[language] = emailTemplateSet{text: text, html: html}
+	}
+	return sets, nil
+}
+func validLanguage(language string) bool {
+	for _, l := range languages {
+		if l == language {
+			return true
+		}
+	}
+	return false
+}
+
+// userLanguage returns the email language of the user, users without a preference get Russian.
+func userLanguage(user User) string {
+	if validLanguage(user.Language) {
+		return user.Language
+	}
+	return defaultLanguage
+}
+
+// requestLanguage takes the language query parameter or the first supported Accept-Language.
+func requestLanguage(r *http.Request) string {
+	if language := r.URL.Query().Get("language"); validLanguage(language) {
+		return language
+	}
+	for _, tag := range strings.Split(r.Header.Get("Accept-Language"), ",") {
+		tag, _, _ = strings.Cut(strings.TrimSpace(tag), ";")
+		tag, _, _ = strings.Cut(strings.ToLower(tag), "-")
+		if validLanguage(tag) {
+			return tag
+		}
+	}
+	return defaultLanguage
+}
+
+// renderEmail renders the named email in the language.
+func renderEmail(name string, language string, to string, data map[string]interface{}) (Email, error) {
+	sets, err := emailTemplates()
+	if err != nil {
+		return Email{}, err
+	}
+	set, ok := sets[language]
+	if !ok {
+		return Email{}, errUnknownLanguage
+	}
+	if set.text.Lookup(name+".subject") == nil {
+		return Email{}, errUnknownEmail
+	}
+	var subject, text, html bytes.Buffer
+	if err := set.text.ExecuteTemplate(&subject, name+".subject", data); err != nil {
+		return Email{}, err
+	}
+	if err := set.text.ExecuteTemplate(&text, name+".text", data); err != nil {
+		return Email{}, err
+	}
+	if err := set.html.ExecuteTemplate(&html, name+".html", data); err != nil {
+		return Email{}, err
+	}
+	email := Email{
+		To:      to,
+		Subject: strings.TrimSpace(subject.String()),
+		Body:    strings.TrimSpace(text.String()),
+		Html:    strings.TrimSpace(html.String()),
+	}
+	if link, ok := data["Unsubscribe"].(string); ok {
+		email.Unsubscribe = link
+	}
+	return email, nil
+}
+
+// sendTemplate renders the named email in the language and queues it.
+func sendTemplate(ctx context.Context, to string, language string, name string, data map[string]interface{}) error {
+	email, err := renderEmail(name, language, to, data)
+	if err != nil {
+		return err
+	}
+	return enqueueEmails(ctx, []Email{email})
+}
+
+// sendUserTemplate sends the named email to the user in their language.
+func sendUserTemplate(ctx context.Context, userID string, name string, data map[string]interface{}) error {
+	var user User
+	if err := db.Collection("users").FindOne(ctx, bson.M{"user_id": userID}).Decode(&user); err != nil {
+		return err
+	}
+	return sendTemplate(ctx, user.Email, userLanguage(user), name, data)
+}
+
+// previewData is the sample data emails are previewed with.
+var previewData = map[string]interface{}{
+	"Link":        "https://advprog1.onrender.com/confirmPage?token=preview",
+	"Minutes":     60,
+	"Card":        "Lionel Messi",
+	"Price":       1200,
+	"Fee":         60,
+	"Date":        time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC).Format("02.01.2006 15:04"),
+	"Deal_id":     "663200000000000000000000",
+	"Unsubscribe": "https://advprog1.onrender.com/unsubscribe?token=preview",
+}
+
+// emailPreview renders an email with sample data, format=html returns the html part as a page.
+func emailPreview(w http.ResponseWriter, r *http.Request) {
+	language := r.URL.Query().Get("language")
+	if language == "" {
+		language = defaultLanguage
+	}
+	email, err := renderEmail(r.URL.Query().Get("name"), language, "preview@example.com", previewData)
+	if err == errUnknownEmail || err == errUnknownLanguage {
+		sendErrorMessage(w, "emailPreview", err, "Unknown email or language. Emails: "+strings.Join(emailNames, ", ")+". Languages: "+strings.Join(languages, ", ")+".")
+		return
+	}
+	if err != nil {
+		sendErrorMessage(w, "emailPreview", err, "Error rendering email.")
+		return
+	}
+	if r.URL.Query().Get("format") == "html" {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Write([]byte(email.Html))
+		return
+	}
+	respondWithJSON(w, http.StatusOK, map[string]interface{}{
+		"status": "success",
+		"email":  email,
+	})
+}
+
+// setLanguage saves the email language of the user.
+func setLanguage(w http.ResponseWriter, r *http.Request) {
+	userID, err := actingUserID(r, "user_id")
+	if err != nil {
+		sendForbidden(w, "setLanguage", err)
+		return
+	}
+	language := r.URL.Query().Get("language")
+	if !validLanguage(language) {
+		sendErrorMessage(w, "setLanguage", errUnknownLanguage, "Unknown language. Languages: "+strings.Join(languages, ", ")+".")
+		return
+	}
+	_, err = db.Collection("users").UpdateOne(r.Context(), bson.M{"user_id": userID}, bson.M{"$set": bson.M{"language": language}})
+	if err != nil {
+		sendErrorMessage(w, "setLanguage", err, "Error saving language. Try again.")
+		return
+	}
+	sendSuccessMessage(w, "setLanguage", "Language saved.", "")
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"math"
+	"net/http"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Market fees
+type FeeSchedule struct {
+	ID             string    `bson:"_id,omitempty" json:"id"`
+	Sale_percent   float64   `json:"sale_percent"`
+	Listing_fee    int       `json:"listing_fee"`
+	Effective_from time.Time `json:"effective_from"`
+	Created_at     time.Time `json:"created_at"`
+}
+type FeeTotal struct {
+	Kind   string `bson:"_id" json:"kind"`
+	Amount int    `json:"amount"`
+	Count  int    `json:"count"`
+}
+
+// systemAccount is the wallet collecting the market fees.
+const systemAccount = "system"
+
+// defaultFeeSchedule applies until the first schedule is added by an admin.
+var defaultFeeSchedule = FeeSchedule{
+	Sale_percent: float64(envInt("MARKET_SALE_FEE_PERCENT", 5)),
+	Listing_fee:  envInt("MARKET_LISTING_FEE", 0),
+}
+
+// feeScheduleAt returns the schedule in effect at the given time.
+func feeScheduleAt(ctx context.Context, at time.Time) (FeeSchedule, error) {
+	var schedule FeeSchedule
+	err := db.Collection("fee_schedules").FindOne(ctx, bson.M{"effective_from": bson.M{"$lte": at}}, options.FindOne().SetSort(bson.D{{Key: "effective_from", Value: -1}})).Decode(&schedule)
+	if err == mongo.ErrNoDocuments {
+		return defaultFeeSchedule, nil
+	}
+	return schedule, err
+}
+
+// saleFee is the part of the price kept by the market, rounded down to whole coins.
+func saleFee(price int, schedule FeeSchedule) int {
+	fee := int(math.Floor(float64(price)*schedule.Sale_percent/100 + 1e-9))
+	if fee > price {
+		return price
+	}
+	return fee
+}
+
+// chargeListingFee moves the listing fee of the schedule in effect from the
+// seller to the system account. Pass a mongo.SessionContext to run it inside a transaction.
+func chargeListingFee(ctx context.Context, userID string, dealID string) error {
+	schedule, err := feeScheduleAt(ctx, time.Now())
+	if err != nil {
+		return err
+	}
+	if err := changeCoins(ctx, userID, -schedule.Listing_fee, "listing_fee:"+dealID); err != nil {
+		return err
+	}
+	return changeCoins(ctx, systemAccount, schedule.Listing_fee, "listing_fee:"+dealID)
+}
+func addFeeSchedule(w http.ResponseWriter, r *http.Request) {
+	var schedule FeeSchedule
+	err := json.NewDecoder(r.Body).Decode(&schedule)
+	if err != nil {
+		sendErrorMessage(w, "addFeeSchedule", err, "Error decoding fee schedule. Try again.")
+		return
+	}
+	if schedule.Sale_percent < 0 || schedule.Sale_percent > 100 || schedule.Listing_fee < 0 {
+		sendErrorMessage(w, "addFeeSchedule", errors.New("invalid input"), "Sale percent must be between 0 and 100 and listing fee non negative.")
+		return
+	}
+	schedule.ID = ""
+	schedule.Created_at = time.Now()
+	if schedule.Effective_from.IsZero() {
+		schedule.Effective_from = schedule.Created_at
+	}
+	// past transactions were charged with the old schedule, so it can not be changed backwards
+	if schedule.Effective_from.Before(schedule.Created_at.Add(-time.Minute)) {
+		sendErrorMessage(w, "addFeeSchedule", errors.New("invalid input"), "Effective from date can not be in the past.")
+		return
+	}
+	_, err = db.Collection("fee_schedules").InsertOne(r.Context(), schedule)
+	if err != nil {
+		sendErrorMessage(w, "addFeeSchedule", err, "Error adding fee schedule. Try again.")
+		return
+	}
+	sendSuccessMessage(w, "addFeeSchedule", "Fee schedule effective from "+schedule.Effective_from.Format(time.RFC3339)+" added successfully!", "")
+}
+func feeSchedules(w http.ResponseWriter, r *http.Request) {
+	var list []FeeSchedule
+	cursor, err := db.Collection("fee_schedules").Find(r.Context(), bson.M{}, options.Find().SetSort(bson.D{{Key: "effective_from", Value: -1}}))
+	if err != nil {
+		sendErrorMessage(w, "feeSchedules", err, "Error getting fee schedules. Try to reload page.")
+		return
+	}
+	if err := cursor.All(r.Context(), &list); err != nil {
+		sendErrorMessage(w, "feeSchedules", err, "Error decoding fee schedules. Try to reload page.")
+		return
+	}
+	current, err := feeScheduleAt(r.Context(), time.Now())
+	if err != nil {
+		sendErrorMessage(w, "feeSchedules", err, "Error getting current fee schedule. Try to reload page.")
+		return
+	}
+	respondWithJSON(w, http.StatusOK, map[string]interface{}{
+		"status":    "success",
+		"current":   current,
+		"schedules": list,
+	})
+}
+
+// marketFees reports the fees collected by the system account, optionally between from and to (RFC3339).
+func marketFees(w http.ResponseWriter, r *http.Request) {
+	date := bson.M{}
+	for param, op := range map[string]string{"from": "$gte", "to": "$lt"} {
+		value := r.URL.Query().Get(param)
+		if value == "" {
+			continue
+		}
+		t, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			sendErrorMessage(w, "marketFees", err, "Invalid "+param+" parameter. Use RFC3339 dates.")
+			return
+		}
+		date[op] = t
+	}
+	match := bson.M{"user_id": systemAccount}
+	if len(date) > 0 {
+		match["date"] = date
+	}
+	cursor, err := db.Collection("ledger").Aggregate(r.Context(), mongo.Pipeline{
+		{{Key: "$match", Value: match}},
+		{{Key: "$group", Value: bson.M{
+			"_id":    bson.M{"$arrayElemAt": bson.A{bson.M{"$split": bson.A{"$reason", ":"}}, 0}},
+			"amount": bson.M{"$sum": "$amount"},
+			"count":  bson.M{"$sum": 1},
+		}}},
+		{{Key: "$sort", Value: bson.M{"_id": 1}}},
+	})
+	if err != nil {
+		sendErrorMessage(w, "marketFees", err, "Error getting collected fees. Try to reload page.")
+		return
+	}
+	totals := []FeeTotal{}
+	if err := cursor.All(r.Context(), &totals); err != nil {
+		sendErrorMessage(w, "marketFees", err, "Error decoding collected fees. Try to reload page.")
+		return
+	}
+	total := 0
+	for _, t := range totals {
+		total += t.Amount
+	}
+	respondWithJSON(w, http.StatusOK, map[string]interface{}{
+		"status": "success",
+		"fees":   totals,
+		"total":  total,
+	})
+}
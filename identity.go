@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// Identity is the user acting in a request, taken from the token claims by authenticate.
+type Identity struct {
+	User_id    string
+	Roles      []string
+	Session_id string
+	// MFA tells whether the session passed two-factor authentication.
+	MFA bool
+}
+type identityKey struct{}
+
+var errUnauthenticated = errors.New("no authenticated user")
+var errForbiddenUser = errors.New("acting for another user requires the admin role")
+
+func withIdentity(ctx context.Context, identity Identity) context.Context {
+	return context.WithValue(ctx, identityKey{}, identity)
+}
+func identityFrom(r *http.Request) (Identity, bool) {
+	identity, ok := r.Context().Value(identityKey{}).(Identity)
+	return identity, ok
+}
+func identityFromClaims(claims jwt.MapClaims) Identity {
+	identity := Identity{Roles: claimRoles(claims)}
+	identity.User_id, _ = claims["sub"].(string)
+	identity.Session_id, _ = claims["sid"].(string)
+	identity.MFA, _ = claims["mfa"].(bool)
+	return identity
+}
+
+// requestToken returns the token of the auth-token cookie or of a Bearer authorization header.
+func requestToken(r *http.Request) (string, bool) {
+	if cookie, err := r.Cookie("auth-token"); err == nil {
+		return cookie.Value, true
+	}
+	header := r.Header.Get("Authorization")
+	if strings.HasPrefix(header, "Bearer ") {
+		return strings.TrimPrefix(header, "Bearer "), true
+	}
+	return "", false
+}
+
+// actAs returns own unless the query parameter names somebody else, which only admins may do.
+func actAs(r *http.Request, param string, own string) (string, error) {
+	value := r.URL.Query().Get(param)
+	if value == "" || value == own {
+		return own, nil
+	}
+	identity, _ := identityFrom(r)
+	if !hasRole(identity.Roles, roleAdmin) {
+		return "", errForbiddenUser
+	}
+	return value, nil
+}
+
+// actingUserID returns the user_id the request acts for.
+func actingUserID(r *http.Request, param string) (string, error) {
+	identity, ok := identityFrom(r)
+	if !ok || identity.User_id == "" {
+		return "", errUnauthenticated
+	}
+	return actAs(r, param, identity.User_id)
+}
+
+// actingAccountID returns the users document id the request acts for, chats and transactions are keyed by it.
+func actingAccountID(r *http.Request, param string) (string, error) {
+	identity, ok := identityFrom(r)
+	if !ok || identity.User_id == "" {
+		return "", errUnauthenticated
+	}
+	var user User
+	err := db.Collection("users").FindOne(r.Context(), bson.M{"user_id": identity.User_id}).Decode(&user)
+	if err != nil {
+		return "", errUnauthenticated
+	}
+	return actAs(r, param, user.ID)
+}
+func sendForbidden(w http.ResponseWriter, action string, err error) {
+	logger.WithFields(logrus.Fields{
+		"action": action,
+		"status": "error",
+		"error":  err.Error(),
+	}).Error("Access denied.")
+	if err == errUnauthenticated {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	http.Error(w, "Forbidden", http.StatusForbidden)
+}
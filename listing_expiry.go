@@ -0,0 +1,233 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Listing expiry
+type ExpiredListing struct {
+	ID         string    `bson:"_id,omitempty" json:"id"`
+	Deal_id    string    `json:"deal_id"`
+	User_id    string    `json:"user_id"`
+	Card_id    Card      `json:"card_id"`
+	Price      int       `json:"price"`
+	Expired_at time.Time `json:"expired_at"`
+}
+
+var listingDuration = time.Duration(envInt("LISTING_DURATION_HOURS", 72)) * time.Hour
+var sweepInterval = time.Duration(envInt("LISTING_SWEEP_SECONDS", 60)) * time.Second
+
+// activeListing matches listings that have not expired yet.
+func activeListing() bson.M {
+	return bson.M{"expires_at": bson.M{"$gt": time.Now()}}
+}
+
+// expiredListingFilter matches listings whose time ran out at now.
+func expiredListingFilter(now time.Time) bson.M {
+	return bson.M{"expires_at": bson.M{"$lte": now}}
+}
+
+// expiredListingOf records the listing returned to the seller.
+func expiredListingOf(deal Deals, now time.Time) ExpiredListing {
+	return ExpiredListing{
+		Deal_id:    deal.ID,
+		User_id:    deal.User_id,
+		Card_id:    deal.Card_id,
+		Price:      deal.Price,
+		Expired_at: now,
+	}
+}
+
+// relistedDeal is the new listing of an expired one, at its old price unless price is set.
+func relistedDeal(listing ExpiredListing, price int, now time.Time) Deals {
+	deal := Deals{
+		User_id:    listing.User_id,
+		Card_id:    listing.Card_id,
+		Price:      listing.Price,
+		Listed_at:  now,
+		Expires_at: now.Add(listingDuration),
+	}
+	if price > 0 {
+		deal.Price = price
+	}
+	return deal
+}
+
+// setMissingExpiry gives listings created before expiry existed a full listing period.
+func setMissingExpiry(ctx context.Context) {
+	_, err := db.Collection("cards_in_deal").UpdateMany(ctx, bson.M{"expires_at": bson.M{"$exists": false}}, bson.M{"$set": bson.M{"expires_at": time.Now().Add(listingDuration)}})
+	if err != nil {
+		logger.WithFields(logrus.Fields{
+			"action": "setMissingExpiry",
+			"status": "error",
+			"error":  err.Error(),
+		}).Error("Error setting expiry of old listings")
+	}
+}
+
+// returnExpiredListing moves one listing of filter back to the sellers collection.
+// The delete and the return happen in one transaction, so when several
+// instances sweep at the same time only one of them can return the card.
+func returnExpiredListing(ctx context.Context, filter bson.M) (*ExpiredListing, error) {
+	var expired *ExpiredListing
+	err := withTransaction(ctx, func(sc mongo.SessionContext) error {
+		expired = nil
+		var deal Deals
+		err := db.Collection("cards_in_deal").FindOneAndDelete(sc, filter, options.FindOneAndDelete().SetSort(bson.M{"expires_at": 1})).Decode(&deal)
+		if err != nil {
+			return err
+		}
+		_, err = db.Collection("collections").UpdateOne(sc, bson.M{"user_id": deal.User_id}, bson.M{"$push": bson.M{"card_id": deal.Card_id}})
+		if err != nil {
+			return err
+		}
+		listing := expiredListingOf(deal, time.Now())
+		result, err := db.Collection("expired_listings").InsertOne(sc, listing)
+		if err != nil {
+			return err
+		}
+		listing.ID = result.InsertedID.(primitive.ObjectID).Hex()
+		expired = &listing
+		return nil
+	})
+	if err == mongo.ErrNoDocuments {
+		return nil, nil
+	}
+	return expired, err
+}
+func notifyExpiredListing(ctx context.Context, listing ExpiredListing) {
+	message := "Your listing of " + listing.Card_id.Name + " for " + strconv.Itoa(listing.Price) + " coins expired, the card was returned to your collection."
+	if err := addNotification(ctx, listing.User_id, notifyListingExpired, message, "/expiredListings"); err != nil {
+		logger.WithFields(logrus.Fields{
+			"action": "notifyExpiredListing",
+			"status": "error",
+			"error":  err.Error(),
+		}).Error("Error adding notification")
+	}
+	var user User
+	if err := db.Collection("users").FindOne(ctx, bson.M{"user_id": listing.User_id}).Decode(&user); err != nil {
+		return
+	}
+	data := map[string]interface{}{"Card": listing.Card_id.Name, "Price": listing.Price, "Link": appURL() + "/expiredListings"}
+	if err := sendTemplate(ctx, user.Email, userLanguage(user), "listing_expired", data); err != nil {
+		logger.WithFields(logrus.Fields{
+			"action": "notifyExpiredListing",
+			"status": "error",
+			"error":  err.Error(),
+		}).Error("Error sending expiry email")
+	}
+}
+func sweepExpiredListings(ctx context.Context) {
+	ticker := time.NewTicker(sweepInterval)
+	defer ticker.Stop()
+	for {
+		for {
+			listing, err := returnExpiredListing(ctx, expiredListingFilter(time.Now()))
+			if err != nil {
+				logger.WithFields(logrus.Fields{
+					"action": "sweepExpiredListings",
+					"status": "error",
+					"error":  err.Error(),
+				}).Error("Error returning expired listing")
+				break
+			}
+			if listing == nil {
+				break
+			}
+			notifyExpiredListing(ctx, *listing)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+func expiredListings(w http.ResponseWriter, r *http.Request) {
+	userID, err := actingUserID(r, "user_id")
+	if err != nil {
+		sendForbidden(w, "expiredListings", err)
+		return
+	}
+	var listings []ExpiredListing
+	cursor, err := db.Collection("expired_listings").Find(r.Context(), bson.M{"user_id": userID}, options.Find().SetSort(bson.D{{Key: "expired_at", Value: -1}}).SetLimit(50))
+	if err != nil {
+		sendErrorMessage(w, "expiredListings", err, "Error getting expired listings. Try to reload page.")
+		return
+	}
+	if err := cursor.All(r.Context(), &listings); err != nil {
+		sendErrorMessage(w, "expiredListings", err, "Error decoding expired listings. Try to reload page.")
+		return
+	}
+	respondWithJSON(w, http.StatusOK, map[string]interface{}{
+		"status":   "success",
+		"listings": listings,
+	})
+}
+func relistCard(w http.ResponseWriter, r *http.Request) {
+	userID, err := actingUserID(r, "user_id")
+	if err != nil {
+		sendForbidden(w, "relistCard", err)
+		return
+	}
+	objID, err := primitive.ObjectIDFromHex(r.URL.Query().Get("id"))
+	if err != nil {
+		sendErrorMessage(w, "relistCard", err, "Invalid id parameter. Try again.")
+		return
+	}
+	price := 0
+	if value := r.URL.Query().Get("price"); value != "" {
+		price, err = strconv.Atoi(value)
+		if err != nil || price < 1 {
+			sendErrorMessage(w, "relistCard", errors.New("invalid input"), "Invalid price. Price must be a positive number of coins.")
+			return
+		}
+	}
+	var deal Deals
+	err = withTransaction(r.Context(), func(sc mongo.SessionContext) error {
+		var listing ExpiredListing
+		err := db.Collection("expired_listings").FindOneAndDelete(sc, bson.M{"_id": objID, "user_id": userID}).Decode(&listing)
+		if err != nil {
+			return err
+		}
+		collection, err := getUserCollection(sc, userID)
+		if err != nil {
+			return err
+		}
+		rest, err := takeCards(collection.Card_id, map[int]int{listing.Card_id.Card_id: 1})
+		if err != nil {
+			return err
+		}
+		_, err = db.Collection("collections").UpdateOne(sc, bson.M{"user_id": userID}, bson.M{"$set": bson.M{"card_id": rest}})
+		if err != nil {
+			return err
+		}
+		deal = relistedDeal(listing, price, time.Now())
+		result, err := db.Collection("cards_in_deal").InsertOne(sc, deal)
+		if err != nil {
+			return err
+		}
+		deal.ID = result.InsertedID.(primitive.ObjectID).Hex()
+		return chargeListingFee(sc, userID, deal.ID)
+	})
+	if err == mongo.ErrNoDocuments {
+		sendErrorMessage(w, "relistCard", err, "Expired listing not found.")
+		return
+	}
+	if err != nil {
+		sendErrorMessage(w, "relistCard", err, "Error putting card back on the market: "+err.Error()+".")
+		return
+	}
+	go matchPriceAlerts(context.Background(), deal)
+	sendSuccessMessage(w, "relistCard", "The card "+deal.Card_id.Name+" is back on the market for "+strconv.Itoa(deal.Price)+" coins.", "")
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"math"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Failed login tracking
+type LoginFailure struct {
+	// ID is "account:<email>" or "ip:<address>".
+	ID           string    `bson:"_id" json:"id"`
+	Kind         string    `json:"kind"`
+	Key          string    `json:"key"`
+	Failures     int       `json:"failures"`
+	Last_failure time.Time `json:"last_failure"`
+	Locked_until time.Time `json:"locked_until"`
+	Expires_at   time.Time `json:"-"`
+}
+
+const (
+	failureAccount = "account"
+	failureIP      = "ip"
+	// freeLoginFailures are allowed before any delay.
+	freeLoginFailures = 3
+)
+
+var maxAccountFailures = envInt("LOGIN_MAX_ACCOUNT_FAILURES", 10)
+var maxIPFailures = envInt("LOGIN_MAX_IP_FAILURES", 50)
+var lockoutDuration = time.Duration(envInt("LOGIN_LOCKOUT_MINUTES", 15)) * time.Minute
+
+// failureWindow is how long failures are remembered after the last one.
+var failureWindow = 24 * time.Hour
+
+var errLoginLocked = errors.New("too many failed login attempts")
+
+// dummyPasswordHash is compared against for unknown emails, so they take as long as a wrong password.
+var dummyPasswordHash = sync.OnceValue(func() string {
+	hash, _ := hashPassword(newTokenID())
+	return hash
+})
+
+func failureID(kind string, key string) string {
+	return kind + ":" + key
+}
+func normalizeEmail(email string) string {
+	return strings.ToLower(strings.TrimSpace(email))
+}
+
+// loginBackoff is how long after the last failure the next attempt is
+// refused: nothing for the first failures, then doubling from a second, and
+// a lockout once max failures are reached.
+func loginBackoff(failures int, max int) time.Duration {
+	if failures >= max {
+		return lockoutDuration
+	}
+	if failures < freeLoginFailures {
+		return 0
+	}
+	delay := time.Duration(math.Pow(2, float64(failures-freeLoginFailures))) * time.Second
+	if delay > lockoutDuration {
+		return lockoutDuration
+	}
+	return delay
+}
+
+func waitSeconds(wait time.Duration) int {
+	return int(math.Ceil(wait.Seconds()))
+}
+
+// loginWait returns how long the email and ip have to wait before the next attempt.
+func loginWait(ctx context.Context, email string, ip string) (time.Duration, error) {
+	ids := bson.A{failureID(failureAccount, normalizeEmail(email)), failureID(failureIP, ip)}
+	cursor, err := db.Collection("login_failures").Find(ctx, bson.M{"_id": bson.M{"$in": ids}, "locked_until": bson.M{"$gt": time.Now()}})
+	if err != nil {
+		return 0, err
+	}
+	var failures []LoginFailure
+	if err := cursor.All(ctx, &failures); err != nil {
+		return 0, err
+	}
+	var wait time.Duration
+	for _, failure := range failures {
+		if until := time.Until(failure.Locked_until); until > wait {
+			wait = until
+		}
+	}
+	return wait, nil
+}
+
+// recordLoginFailure counts a failed attempt for the email and the ip.
+func recordLoginFailure(ctx context.Context, email string, ip string) error {
+	for _, entry := range []struct {
+		kind string
+		key  string
+		max  int
+	}{
+		{failureAccount, normalizeEmail(email), maxAccountFailures},
+		{failureIP, ip, maxIPFailures},
+	} {
+		now := time.Now()
+		update := bson.M{
+			"$inc": bson.M{"failures": 1},
+			"$set": bson.M{"kind": entry.kind, "key": entry.key, "last_failure": now},
+		}
+		var failure LoginFailure
+		opts := options.FindOneAndUpdate().SetUpsert(true).SetReturnDocument(options.After)
+		err := db.Collection("login_failures").FindOneAndUpdate(ctx, bson.M{"_id": failureID(entry.kind, entry.key)}, update, opts).Decode(&failure)
+		if err != nil {
+			return err
+		}
+		lockedUntil := now.Add(loginBackoff(failure.Failures, entry.max))
+		_, err = db.Collection("login_failures").UpdateOne(ctx, bson.M{"_id": failure.ID}, bson.M{"$set": bson.M{
+			"locked_until": lockedUntil,
+			"expires_at":   lockedUntil.Add(failureWindow),
+		}})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// clearLoginFailures forgets the failures of the account after a successful login.
+func clearLoginFailures(ctx context.Context, email string) error {
+	_, err := db.Collection("login_failures").DeleteOne(ctx, bson.M{"_id": failureID(failureAccount, normalizeEmail(email))})
+	return err
+}
+
+// lockoutFilter selects the entries of the email and ip query parameters, or all of them.
+func lockoutFilter(r *http.Request) bson.M {
+	var ids bson.A
+	if email := r.URL.Query().Get("email"); email != "" {
+		ids = append(ids, failureID(failureAccount, normalizeEmail(email)))
+	}
+	if ip := r.URL.Query().Get("ip"); ip != "" {
+		ids = append(ids, failureID(failureIP, ip))
+	}
+	if len(ids) == 0 {
+		return bson.M{}
+	}
+	return bson.M{"_id": bson.M{"$in": ids}}
+}
+func loginLockouts(w http.ResponseWriter, r *http.Request) {
+	filter := lockoutFilter(r)
+	if r.URL.Query().Get("locked") == "true" {
+		filter["locked_until"] = bson.M{"$gt": time.Now()}
+	}
+	list := []LoginFailure{}
+	cursor, err := db.Collection("login_failures").Find(r.Context(), filter, options.Find().SetSort(bson.D{{Key: "last_failure", Value: -1}}).SetLimit(200))
+	if err != nil {
+		sendErrorMessage(w, "loginLockouts", err, "Error getting lockouts. Try to reload page.")
+		return
+	}
+	if err := cursor.All(r.Context(), &list); err != nil {
+		sendErrorMessage(w, "loginLockouts", err, "Error decoding lockouts. Try to reload page.")
+		return
+	}
+	respondWithJSON(w, http.StatusOK, map[string]interface{}{
+		"status":   "success",
+		"lockouts": list,
+	})
+}
+func clearLockout(w http.ResponseWriter, r *http.Request) {
+	filter := lockoutFilter(r)
+	if len(filter) == 0 {
+		sendErrorMessage(w, "clearLockout", errors.New("invalid input"), "Enter an email or ip.")
+		return
+	}
+	result, err := db.Collection("login_failures").DeleteMany(r.Context(), filter)
+	if err != nil {
+		sendErrorMessage(w, "clearLockout", err, "Error clearing lockout. Try again.")
+		return
+	}
+	if result.DeletedCount == 0 {
+		sendErrorMessage(w, "clearLockout", mongo.ErrNoDocuments, "Lockout not found.")
+		return
+	}
+	sendSuccessMessage(w, "clearLockout", "Lockout cleared.", "")
+}
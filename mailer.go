@@ -0,0 +1,365 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"gopkg.in/gomail.v2"
+)
+
+// Mail
+type Email struct {
+	To      string `json:"to"`
+	Subject string `json:"subject"`
+	Body    string `json:"body"`
+	// Html is the optional html alternative of Body.
+	Html string `bson:"html,omitempty" json:"html,omitempty"`
+	// Unsubscribe is the unsubscribe link of bulk emails.
+	Unsubscribe string `bson:"unsubscribe,omitempty" json:"unsubscribe,omitempty"`
+}
+
+// Mailer delivers an email, handlers never call it directly but enqueue into the outbox.
+type Mailer interface {
+	Send(email Email) error
+}
+
+// smtpMailer sends through an SMTP server.
+type smtpMailer struct {
+	Host     string
+	Port     int
+	Username string
+	Password string
+	From     string
+}
+
+func (m smtpMailer) Send(email Email) error {
+	message := gomail.NewMessage()
+	message.SetHeader("From", m.From)
+	message.SetHeader("To", email.To)
+	message.SetHeader("Subject", email.Subject)
+	message.SetBody("text/plain", email.Body)
+	if email.Unsubscribe != "" {
+		message.SetHeader("List-Unsubscribe", "<"+email.Unsubscribe+">")
+		message.SetHeader("List-Unsubscribe-Post", "List-Unsubscribe=One-Click")
+	}
+	if email.Html != "" {
+		message.AddAlternative("text/html", email.Html)
+	}
+	return gomail.NewDialer(m.Host, m.Port, m.Username, m.Password).DialAndSend(message)
+}
+
+// fileMailer appends emails to a file instead of sending them, for development.
+type fileMailer struct {
+	Path string
+	mu   sync.Mutex
+}
+
+func (m *fileMailer) Send(email Email) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	file, err := os.OpenFile(m.Path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	_, err = fmt.Fprintf(file, "To: %s\nSubject: %s\nDate: %s\n\n%s\n\n", email.To, email.Subject, time.Now().Format(time.RFC1123Z), email.Body)
+	if err == nil && email.Html != "" {
+		_, err = fmt.Fprintf(file, "%s\n\n", email.Html)
+	}
+	return err
+}
+
+// logMailer only logs the recipient and subject of emails, for development.
+// Bodies hold confirmation and password reset links and never go to the log.
+type logMailer struct{}
+
+func (logMailer) Send(email Email) error {
+	logger.WithFields(logrus.Fields{
+		"action":  "sendEmail",
+		"status":  "success",
+		"to":      email.To,
+		"subject": email.Subject,
+	}).Info("Email not delivered, MAILER is not set")
+	return nil
+}
+
+// memoryMailer keeps the sent emails, for tests. Err makes every send fail.
+type memoryMailer struct {
+	mu   sync.Mutex
+	Sent []Email
+	Err  error
+}
+
+func (m *memoryMailer) Send(email Email) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.Err != nil {
+		return m.Err
+	}
+	m.Sent = append(m.Sent, email)
+	return nil
+}
+
+// outboxMailer queues the emails, the mail workers deliver them.
+type outboxMailer struct {
+	ctx context.Context
+}
+
+func (m outboxMailer) Send(email Email) error {
+	return enqueueEmails(m.ctx, []Email{email})
+}
+
+var mailer Mailer = logMailer{}
+
+// loadMailer picks the mailer of MAILER: smtp (SMTP_HOST, SMTP_PORT,
+// SMTP_USERNAME, SMTP_PASSWORD, MAIL_FROM), file (MAIL_FILE) or log.
+func loadMailer() Mailer {
+	switch os.Getenv("MAILER") {
+	case "smtp":
+		host := os.Getenv("SMTP_HOST")
+		if host == "" {
+			host = "smtp.gmail.com"
+		}
+		from := os.Getenv("MAIL_FROM")
+		if from == "" {
+			from = os.Getenv("SMTP_USERNAME")
+		}
+		return smtpMailer{
+			Host:     host,
+			Port:     envInt("SMTP_PORT", 587),
+			Username: os.Getenv("SMTP_USERNAME"),
+			Password: os.Getenv("SMTP_PASSWORD"),
+			From:     from,
+		}
+	case "file":
+		path := os.Getenv("MAIL_FILE")
+		if path == "" {
+			path = "logs/mail.log"
+		}
+		return &fileMailer{Path: path}
+	case "", "log":
+		logger.WithFields(logrus.Fields{
+			"action": "loadMailer",
+			"status": "warning",
+		}).Warn("MAILER is not smtp, emails are only logged.")
+		return logMailer{}
+	}
+	logger.WithFields(logrus.Fields{
+		"action": "loadMailer",
+		"status": "error",
+	}).Fatal("Unknown MAILER " + os.Getenv("MAILER"))
+	return nil
+}
+
+// Outbox
+type OutboxEmail struct {
+	ID           primitive.ObjectID `bson:"_id,omitempty" json:"id"`
+	Email        `bson:",inline"`
+	Campaign_id  string    `bson:"campaign_id,omitempty" json:"campaign_id,omitempty"`
+	Status       string    `json:"status"`
+	Attempts     int       `json:"attempts"`
+	Next_attempt time.Time `json:"next_attempt"`
+	Locked_until time.Time `json:"-"`
+	Last_error   string    `json:"last_error,omitempty"`
+	Created_at   time.Time `json:"created_at"`
+	Sent_at      time.Time `json:"sent_at,omitempty"`
+	// Expires_at is set when the email was sent, sent emails are kept for a while only.
+	Expires_at *time.Time `json:"-" bson:"expires_at,omitempty"`
+}
+
+const (
+	outboxPending = "pending"
+	outboxSending = "sending"
+	outboxSent    = "sent"
+	outboxDead    = "dead"
+)
+
+var maxEmailAttempts = envInt("MAIL_MAX_ATTEMPTS", 8)
+var mailWorkers = envInt("MAIL_WORKERS", 2)
+var mailPollInterval = 5 * time.Second
+var mailSendTimeout = time.Minute
+var sentEmailRetention = 7 * 24 * time.Hour
+
+// emailBackoff is the wait before the next attempt after failed attempts: 30s doubling up to 6h.
+func emailBackoff(attempts int) time.Duration {
+	delay := time.Duration(math.Pow(2, float64(attempts-1))) * 30 * time.Second
+	if delay > 6*time.Hour || delay <= 0 {
+		return 6 * time.Hour
+	}
+	return delay
+}
+
+func enqueueEmails(ctx context.Context, emails []Email) error {
+	return enqueueCampaignEmails(ctx, "", emails)
+}
+func enqueueCampaignEmails(ctx context.Context, campaignID string, emails []Email) error {
+	if len(emails) == 0 {
+		return nil
+	}
+	now := time.Now()
+	docs := make([]interface{}, len(emails))
+	for i, email := range emails {
+		docs[i] = OutboxEmail{Email: email, Campaign_id: campaignID, Status: outboxPending, Next_attempt: now, Created_at: now}
+	}
+	_, err := db.Collection("outbox").InsertMany(ctx, docs)
+	return err
+}
+
+// claimEmail takes the next due email. An email left sending by a stopped
+// worker is claimed again once its lock ran out.
+func claimEmail(ctx context.Context) (OutboxEmail, error) {
+	now := time.Now()
+	filter := bson.M{"$or": bson.A{
+		bson.M{"status": outboxPending, "next_attempt": bson.M{"$lte": now}},
+		bson.M{"status": outboxSending, "locked_until": bson.M{"$lte": now}},
+	}}
+	update := bson.M{"$set": bson.M{"status": outboxSending, "locked_until": now.Add(mailSendTimeout)}}
+	opts := options.FindOneAndUpdate().SetSort(bson.D{{Key: "next_attempt", Value: 1}}).SetReturnDocument(options.After)
+	var email OutboxEmail
+	err := db.Collection("outbox").FindOneAndUpdate(ctx, filter, update, opts).Decode(&email)
+	return email, err
+}
+
+// deliverEmail sends a claimed email and records the result, an email
+// failing maxEmailAttempts times is dead-lettered.
+func deliverEmail(ctx context.Context, m Mailer, email OutboxEmail) error {
+	sendErr := m.Send(email.Email)
+	now := time.Now()
+	set := bson.M{}
+	if sendErr == nil {
+		set["status"] = outboxSent
+		set["sent_at"] = now
+		set["expires_at"] = now.Add(sentEmailRetention)
+	} else {
+		set["last_error"] = sendErr.Error()
+		set["status"] = outboxPending
+		set["next_attempt"] = now.Add(emailBackoff(email.Attempts + 1))
+		if email.Attempts+1 >= maxEmailAttempts {
+			set["status"] = outboxDead
+		}
+	}
+	update := bson.M{"$set": set}
+	if sendErr != nil {
+		update["$inc"] = bson.M{"attempts": 1}
+	}
+	if _, err := db.Collection("outbox").UpdateOne(ctx, bson.M{"_id": email.ID}, update); err != nil {
+		return err
+	}
+	if email.Campaign_id != "" && set["status"] == outboxSent {
+		countCampaignDelivery(ctx, email.Campaign_id, "sent", 1)
+	}
+	if email.Campaign_id != "" && set["status"] == outboxDead {
+		countCampaignDelivery(ctx, email.Campaign_id, "failed", 1)
+	}
+	return sendErr
+}
+func mailWorker(ctx context.Context) {
+	for {
+		if campaign, err := claimCampaign(ctx); err == nil {
+			if err := fanOutCampaign(ctx, campaign); err != nil {
+				logger.WithFields(logrus.Fields{
+					"action":   "mailWorker",
+					"status":   "error",
+					"error":    err.Error(),
+					"campaign": campaign.ID.Hex(),
+				}).Error("Error queueing campaign")
+			}
+		} else if err != mongo.ErrNoDocuments {
+			logger.WithFields(logrus.Fields{
+				"action": "mailWorker",
+				"status": "error",
+				"error":  err.Error(),
+			}).Error("Error claiming campaign")
+		}
+		email, err := claimEmail(ctx)
+		if err != nil {
+			if err != mongo.ErrNoDocuments {
+				logger.WithFields(logrus.Fields{
+					"action": "mailWorker",
+					"status": "error",
+					"error":  err.Error(),
+				}).Error("Error claiming email")
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(mailPollInterval):
+			}
+			continue
+		}
+		if err := deliverEmail(ctx, mailer, email); err != nil {
+			logger.WithFields(logrus.Fields{
+				"action": "mailWorker",
+				"status": "error",
+				"error":  err.Error(),
+				"to":     email.To,
+			}).Error("Error sending email")
+		}
+	}
+}
+
+// startMailWorkers starts MAIL_WORKERS workers draining the outbox.
+func startMailWorkers(ctx context.Context) {
+	for i := 0; i < mailWorkers; i++ {
+		go mailWorker(ctx)
+	}
+}
+
+// outboxRedacted leaves out the contents of the emails, they hold live
+// confirmation and password reset links.
+var outboxRedacted = bson.M{"body": 0, "html": 0, "unsubscribe": 0}
+
+func outbox(w http.ResponseWriter, r *http.Request) {
+	status := r.URL.Query().Get("status")
+	if status == "" {
+		status = outboxDead
+	}
+	list := []OutboxEmail{}
+	cursor, err := db.Collection("outbox").Find(r.Context(), bson.M{"status": status}, options.Find().SetSort(bson.D{{Key: "created_at", Value: -1}}).SetLimit(200).SetProjection(outboxRedacted))
+	if err != nil {
+		sendErrorMessage(w, "outbox", err, "Error getting outbox. Try to reload page.")
+		return
+	}
+	if err := cursor.All(r.Context(), &list); err != nil {
+		sendErrorMessage(w, "outbox", err, "Error decoding outbox. Try to reload page.")
+		return
+	}
+	respondWithJSON(w, http.StatusOK, map[string]interface{}{
+		"status": "success",
+		"emails": list,
+	})
+}
+
+// retryEmail puts a dead-lettered email back into the queue.
+func retryEmail(w http.ResponseWriter, r *http.Request) {
+	id, err := primitive.ObjectIDFromHex(r.URL.Query().Get("id"))
+	if err != nil {
+		sendErrorMessage(w, "retryEmail", err, "Invalid email id.")
+		return
+	}
+	update := bson.M{"$set": bson.M{"status": outboxPending, "attempts": 0, "next_attempt": time.Now()}}
+	var email OutboxEmail
+	err = db.Collection("outbox").FindOneAndUpdate(r.Context(), bson.M{"_id": id, "status": outboxDead}, update).Decode(&email)
+	if err == mongo.ErrNoDocuments {
+		sendErrorMessage(w, "retryEmail", err, "Email not found in dead letters.")
+		return
+	}
+	if err != nil {
+		sendErrorMessage(w, "retryEmail", err, "Error retrying email. Try again.")
+		return
+	}
+	if email.Campaign_id != "" {
+		countCampaignDelivery(r.Context(), email.Campaign_id, "failed", -1)
+	}
+	sendSuccessMessage(w, "retryEmail", "Email queued again.", "")
+}
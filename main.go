@@ -25,27 +25,26 @@ import (
 	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
-	"golang.org/x/crypto/bcrypt"
-	"golang.org/x/time/rate"
-	"gopkg.in/gomail.v2"
 )
 
 var db *mongo.Database
 var logger *logrus.Logger
 var tmpl *template.Template
-var limiter = rate.NewLimiter(1, 3)
 var upgrader = websocket.Upgrader{
 	ReadBufferSize:  1024,
 	WriteBufferSize: 1024,
 }
-var adminConn *websocket.Conn
-var userConns = make(map[*websocket.Conn]bool)
 type Chat struct {
 	ID string `bson:"_id,omitempty"`
 	Id_support string `bson:"id_support"`
 	Id_client string `bson:"id_client"`
 	Is_finished bool `bson:"is_finished"`
 	Messages []Message `bson:"messages"`
+	Created_at time.Time `bson:"created_at"`
+	Assigned_at time.Time `bson:"assigned_at,omitempty"`
+	First_response_at time.Time `bson:"first_response_at,omitempty"`
+	Finished_at time.Time `bson:"finished_at,omitempty"`
+	Transfers []ChatTransfer `bson:"transfers,omitempty"`
 }
 type Message struct{
 		Sender string `bson:"sender_id"`
@@ -54,15 +53,25 @@ type Message struct{
 		Timestamp   time.Time `bson:"time"`
 }
 type User struct {
-	ID       string `bson:"_id,omitempty"`
-	User_id  string `json:"user_id"`
-	Email    string `json:"email"`
-	Password string `json:"password"`
+	ID       string   `bson:"_id,omitempty"`
+	User_id  string   `json:"user_id"`
+	Email    string   `json:"email"`
+	Password string   `bson:"password,omitempty" json:"-"`
+	Roles    []string `bson:"roles,omitempty" json:"roles"`
+	// Language of the emails sent to the user, one of languages.
+	Language string `bson:"language,omitempty" json:"language"`
+	// Email_preferences holds the bulk email topics the user chose, see emailTopics.
+	Email_preferences map[string]bool `bson:"email_preferences,omitempty" json:"email_preferences"`
 }
 type ConfirmUser struct {
-	ID       string `bson:"_id,omitempty"`
-	Email    string `json:"email"`
-	Password string `json:"password"`
+	ID         string    `bson:"_id,omitempty"`
+	Email      string    `json:"email"`
+	Password   string    `json:"password"`
+	Token_hash string    `json:"-"`
+	Expires_at time.Time `json:"-"`
+	Last_sent  time.Time `json:"-"`
+	Confirmed  bool      `json:"-"`
+	Language   string    `json:"-"`
 }
 type Card struct {
 	Card_id     int    `json:"card_id"`
@@ -70,19 +79,26 @@ type Card struct {
 	Nationality string `json:"nationality"`
 	Club        string `json:"club"`
 	Position    string `json:"position"`
+	Rarity      string `json:"rarity"`
 }
 type Deals struct {
-	ID      string `bson:"_id,omitempty"`
-	User_id string `json:"user_id"`
-	Card_id Card   `json:"card_id"`
+	ID         string    `bson:"_id,omitempty"`
+	User_id    string    `json:"user_id"`
+	Card_id    Card      `json:"card_id"`
+	Price      int       `json:"price"`
+	Listed_at  time.Time `json:"listed_at"`
+	Expires_at time.Time `json:"expires_at"`
 }
 type Collections struct {
 	User_id string `json:"user_id"`
 	Card_id []Card `json:"card_id"`
 }
 type Card_in_deal struct {
-	User_id string `json:"user_id"`
-	Card_id Card   `json:"card_id"`
+	User_id    string    `json:"user_id"`
+	Card_id    Card      `json:"card_id"`
+	Price      int       `json:"price"`
+	Listed_at  time.Time `json:"listed_at"`
+	Expires_at time.Time `json:"expires_at"`
 }
 type User_Questions struct {
 	User_id       string      `json:"user_id"`
@@ -143,11 +159,16 @@ func init() {
 }
 
 // CRUD
+// getUserByID returns the account of the token, admins may name another account with id.
 func getUserByID(w http.ResponseWriter, r *http.Request) {
-	userID := r.URL.Query().Get("id")
+	userID, err := actingAccountID(r, "id")
+	if err != nil {
+		sendForbidden(w, "getUserByID", err)
+		return
+	}
 	objID, _ := primitive.ObjectIDFromHex(userID)
 	var user User
-	err := db.Collection("users").FindOne(r.Context(), bson.M{"_id": objID}).Decode(&user)
+	err = db.Collection("users").FindOne(r.Context(), bson.M{"_id": objID}).Decode(&user)
 	if err != nil {
 		logger.WithFields(logrus.Fields{
 			"action": "getUserByID",
@@ -163,7 +184,6 @@ func getUserByID(w http.ResponseWriter, r *http.Request) {
 	logger.WithFields(logrus.Fields{
 		"action": "getUserByID",
 		"status": "success",
-		"user":   user,
 	}).Info("User  was found")
 	respondWithJSON(w, http.StatusOK, map[string]interface{}{
 		"status": "success",
@@ -177,15 +197,15 @@ func createUser(w http.ResponseWriter, r *http.Request) {
 	}
 	email := r.URL.Query().Get("email")
 	password := r.URL.Query().Get("password")
-	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	hashedPassword, err := hashPassword(password)
+	if err == errWeakPassword {
+		sendErrorMessage(w, "createUser", err, "Invalid password: "+err.Error()+".")
+		return
+	}
 	if err != nil {
 		sendErrorMessage(w, "createUser", err, "Error hashing password. Try to register again.")
 		return
 	}
-	newUser := ConfirmUser{
-		Email:    email,
-		Password: string(hashedPassword),
-	}
 	existingUser := User{}
 	err = db.Collection("users").FindOne(r.Context(), bson.M{"email": email}).Decode(&existingUser)
 	if err == nil {
@@ -193,32 +213,25 @@ func createUser(w http.ResponseWriter, r *http.Request) {
 		sendErrorMessage(w, "createUser", errors.New(errorMessage), errorMessage)
 		return
 	}
-	_, err = db.Collection("confirm_users").InsertOne(r.Context(), newUser)
+	token, err := storePendingUser(r.Context(), email, hashedPassword, requestLanguage(r))
+	if err == errVerificationThrottled {
+		sendErrorMessage(w, "createUser", err, "A confirmation email was sent recently. Try again in a minute.")
+		return
+	}
 	if err != nil {
 		errorMessage := "error add user. try again"
 		sendErrorMessage(w, "createUser", errors.New(errorMessage), errorMessage)
 		return
 	}
 	////////////////////////////////// gmail message
-	body := fmt.Sprintf("Для подтверждения почты перейдите по ссылке: https://advprog1.onrender.com/confirmPage?email=%s", email)
-
-	// Настройка клиента для отправки письма
-	m := gomail.NewMessage()
-	m.SetHeader("From", "nurlanovernur33@gmail.com")
-	m.SetHeader("To", email)
-	m.SetHeader("Subject", "Подтверждение почты")
-	m.SetBody("text/plain", body)
-
-	// Отправка письма
-	d := gomail.NewDialer("smtp.gmail.com", 587, "nurlanovernur33@gmail.com", "hlwa hlzl epre rhfd")
-	if err := d.DialAndSend(m); err != nil {
+	if err := sendVerificationEmail(r.Context(), email, requestLanguage(r), token); err != nil {
 		sendErrorMessage(w, "createUser", err, "Error send message. Try again.")
 		return
 	}
 	sendSuccessMessage(w, "createUser", "User created successfully. Confirm your email and log in.", "")
 }
 func confirmPage(w http.ResponseWriter, r *http.Request) {
-	email := r.URL.Query().Get("email")
+	token := r.URL.Query().Get("token")
 	tmpl, err := template.ParseFiles("confirm.html")
 	if err != nil {
 		logger.WithFields(logrus.Fields{
@@ -229,62 +242,87 @@ func confirmPage(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
 		return
 	}
-	tmpl.ExecuteTemplate(w, "confirm.html", email)
+	tmpl.ExecuteTemplate(w, "confirm.html", token)
 	logger.WithFields(logrus.Fields{
 		"action": "registerPage",
 		"status": "success",
 	}).Info("User on the page.")
 }
 func confirm(w http.ResponseWriter, r *http.Request) {
-	email := r.URL.Query().Get("email")
-	userID, _ := db.Collection("users").CountDocuments(r.Context(), bson.M{})
-	var user ConfirmUser
-	err := db.Collection("confirm_users").FindOne(r.Context(), bson.M{"email": email}).Decode(&user)
+	token := r.URL.Query().Get("token")
+	created := false
+	err := withTransaction(r.Context(), func(sc mongo.SessionContext) error {
+		created = false
+		// the token stays valid until it expires so that confirming twice is not an error
+		var user ConfirmUser
+		filter := bson.M{"token_hash": hashSecret(token), "expires_at": bson.M{"$gt": time.Now()}}
+		err := db.Collection("confirm_users").FindOneAndUpdate(sc, filter, bson.M{"$set": bson.M{"confirmed": true}}).Decode(&user)
+		if err != nil || user.Confirmed {
+			return err
+		}
+		created = true
+		return createAccount(sc, user)
+	})
+	if err == mongo.ErrNoDocuments {
+		sendErrorMessage(w, "confirm", err, "The confirmation link is invalid or expired. Request a new one.")
+		return
+	}
 	if err != nil {
-		sendErrorMessage(w, "confirm", err, "Error finding user by email. Try again.")
+		sendErrorMessage(w, "confirm", err, "Error confirming email. Try again.")
+		return
+	}
+	if !created {
+		sendSuccessMessage(w, "confirm", "Email already confirmed. You can log in", "")
 		return
 	}
+	sendSuccessMessage(w, "confirm", "Email confirmed successfully. You can log in", "")
+}
+
+// createAccount creates the user of a confirmed registration with an empty
+// collection, team and daily questions.
+func createAccount(ctx context.Context, user ConfirmUser) error {
+	userID, err := db.Collection("users").CountDocuments(ctx, bson.M{})
+	if err != nil {
+		return err
+	}
 	newUser := User{
 		User_id:  strconv.FormatInt(userID+1, 10),
 		Email:    user.Email,
 		Password: user.Password,
+		Roles:    []string{roleUser},
+		Language: user.Language,
 	}
-	_, err = db.Collection("users").InsertOne(r.Context(), newUser)
+	_, err = db.Collection("users").InsertOne(ctx, newUser)
 	if err != nil {
-		sendErrorMessage(w, "confirm", err, "Error adding user. Try again.")
-		return
+		return err
 	}
 	newUserCollection := Collections{
 		User_id: strconv.FormatInt(userID+1, 10),
 		Card_id: []Card{},
 	}
-	_, err = db.Collection("collections").InsertOne(r.Context(), newUserCollection)
+	_, err = db.Collection("collections").InsertOne(ctx, newUserCollection)
 	if err != nil {
-		sendErrorMessage(w, "confirm", err, "Error creating users collection. Try again.")
-		return
+		return err
 	}
-	questionSize, err := db.Collection("questions").CountDocuments(r.Context(), bson.M{})
+	questionSize, err := db.Collection("questions").CountDocuments(ctx, bson.M{})
 	if err != nil {
-		sendErrorMessage(w, "confirm", err, "Error getting collection size. Try to relod page.")
-		return
+		return err
 	}
 	randomNumbers := make([]int, 5)
 	for i := 0; i < 5; i++ {
 		randomNumbers[i] = rand.Intn(int(questionSize))
 	}
-	cursor, err := db.Collection("questions").Find(r.Context(), bson.M{"question_id": bson.M{"$in": randomNumbers}})
+	cursor, err := db.Collection("questions").Find(ctx, bson.M{"question_id": bson.M{"$in": randomNumbers}})
 	if err != nil {
-		sendErrorMessage(w, "confirm", err, "Error adding questions to user. Try to relod page.")
-		return
+		return err
 	}
 	var questions []Questions
-	defer cursor.Close(r.Context())
-	for cursor.Next(r.Context()) {
+	defer cursor.Close(ctx)
+	for cursor.Next(ctx) {
 		var question Questions
 		err := cursor.Decode(&question)
 		if err != nil {
-			sendErrorMessage(w, "confirm", err, "Error decoding file. Try to relod page.")
-			return
+			return err
 		}
 		questions = append(questions, question)
 	}
@@ -293,26 +331,19 @@ func confirm(w http.ResponseWriter, r *http.Request) {
 		UserQuestions: questions,
 		Submit:        false,
 	}
-	_, err = db.Collection("user_questions").InsertOne(r.Context(), newUserQuestions)
+	_, err = db.Collection("user_questions").InsertOne(ctx, newUserQuestions)
 	if err != nil {
-		sendErrorMessage(w, "confirm", err, "Error creating users questions. Try again.")
-		return
+		return err
 	}
 	newUserTeam := Teams{
 		User_id:     strconv.FormatInt(userID+1, 10),
 		UserPlayers: []Player{},
 	}
-	_, err = db.Collection("teams").InsertOne(r.Context(), newUserTeam)
-	if err != nil {
-		sendErrorMessage(w, "confirm", err, "Error creating users team. Try again.")
-		return
-	}
-	_, err = db.Collection("confirm_users").DeleteOne(r.Context(), bson.M{"email": email})
+	_, err = db.Collection("teams").InsertOne(ctx, newUserTeam)
 	if err != nil {
-		sendErrorMessage(w, "confirm", err, "Error creating users team. Try again.")
-		return
+		return err
 	}
-	sendSuccessMessage(w, "confirm", "Email confirmed successfully. You can log in", "")
+	return nil
 }
 func login(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
@@ -321,36 +352,70 @@ func login(w http.ResponseWriter, r *http.Request) {
 	}
 	email := r.URL.Query().Get("email")
 	password := r.URL.Query().Get("password")
-	existingUser := User{}
-	err := db.Collection("users").FindOne(r.Context(), bson.M{"email": email}).Decode(&existingUser)
+	ip := clientIP(r)
+	wait, err := loginWait(r.Context(), email, ip)
 	if err != nil {
-		sendErrorMessage(w, "login", err, "Incorrect login entered. Try again.")
+		sendErrorMessage(w, "login", err, "Failed to log in. Try again.")
+		return
+	}
+	if wait > 0 {
+		sendErrorMessage(w, "login", errLoginLocked, "Too many failed attempts. Try again in "+strconv.Itoa(waitSeconds(wait))+" seconds.")
+		return
+	}
+	existingUser := User{}
+	err = db.Collection("users").FindOne(r.Context(), bson.M{"email": email}).Decode(&existingUser)
+	if err == mongo.ErrNoDocuments {
+		// unknown emails fail the same way and take as long as a wrong password
+		existingUser.Password = dummyPasswordHash()
+	} else if err != nil {
+		sendErrorMessage(w, "login", err, "Failed to log in. Try again.")
+		return
+	}
+	if err := checkPassword(existingUser.Password, password); err != nil || existingUser.User_id == "" {
+		if err := recordLoginFailure(r.Context(), email, ip); err != nil {
+			sendErrorMessage(w, "login", err, "Failed to log in. Try again.")
+			return
+		}
+		sendErrorMessage(w, "login", errWrongPassword, "Incorrect email or password. Try again.")
 		return
 	}
-	err = bcrypt.CompareHashAndPassword([]byte(existingUser.Password), []byte(password))
+	enabled, err := twoFactorEnabled(r.Context(), existingUser.User_id)
 	if err != nil {
-		sendErrorMessage(w, "login", err, "Incorrect password entered. Try again.")
+		sendErrorMessage(w, "login", err, "Failed to generate token. Try to log in again.")
+		return
+	}
+	if enabled {
+		challenge, err := startLoginChallenge(r.Context(), existingUser.User_id)
+		if err != nil {
+			sendErrorMessage(w, "login", err, "Failed to generate token. Try to log in again.")
+			return
+		}
+		sendSuccessMessage(w, "login", "TwoFactor", challenge)
 		return
 	}
-	token, err := generateToken(&existingUser)
+	finishLogin(w, r, &existingUser, false)
+}
 
-	http.SetCookie(w, &http.Cookie{
-			Name:     "auth-token",
-			Value:    token,
-			HttpOnly: true,
-			Path:     "/",
-	})
-	http.SetCookie(w, &http.Cookie{
-		Name:  "user-data",
-		Value: existingUser.ID,
-		Path:  "/",
-	})
-	
+// finishLogin starts the session once the password and, when enabled, the second factor were checked.
+// Failures are only cleared here, a right password alone must not reset the count of wrong codes.
+func finishLogin(w http.ResponseWriter, r *http.Request, user *User, mfa bool) {
+	if err := clearLoginFailures(r.Context(), user.Email); err != nil {
+		sendErrorMessage(w, "login", err, "Failed to log in. Try again.")
+		return
+	}
+	token, refresh, err := startSession(r.Context(), r, user, mfa)
 	if err != nil {
 		sendErrorMessage(w, "login", err, "Failed to generate token. Try to log in again.")
 		return
 	}
-	if email == "admin@gmail.com" {
+	setSessionCookies(w, token, refresh)
+	http.SetCookie(w, &http.Cookie{
+		Name:  "user-data",
+		Value: user.ID,
+		Path:  "/",
+	})
+
+	if hasPermission(userRoles(*user), permAdminPage) {
 		sendSuccessMessage(w, "login", "Admin", token)
 		return
 	}
@@ -443,6 +508,7 @@ func addCard(w http.ResponseWriter, r *http.Request) {
 		Nationality string `json:"nationality"`
 		Club        string `json:"club"`
 		Position    string `json:"position"`
+		Rarity      string `json:"rarity"`
 	}
 	var data newCard
 	err := json.NewDecoder(r.Body).Decode(&data)
@@ -454,11 +520,19 @@ func addCard(w http.ResponseWriter, r *http.Request) {
 		sendErrorMessage(w, "addCard", errors.New("invalid input"), "Invalid position. Position must be Forward, Midfielder, Defender, Manager or Goalkeeper.")
 		return
 	}
+	if data.Rarity == "" {
+		data.Rarity = "common"
+	}
+	if !validRarity(data.Rarity) {
+		sendErrorMessage(w, "addCard", errors.New("invalid input"), "Invalid rarity. Rarity must be common, rare, epic or legendary.")
+		return
+	}
 	var card Card
 	card.Club = data.Club
 	card.Name = data.Name
 	card.Nationality = data.Nationality
 	card.Position = data.Position
+	card.Rarity = data.Rarity
 	id, err := db.Collection("cards").CountDocuments(r.Context(), bson.M{})
 	if err != nil {
 		sendErrorMessage(w, "addCard", err, "Error get size of cards collection. Try to reload page.")
@@ -470,23 +544,19 @@ func addCard(w http.ResponseWriter, r *http.Request) {
 		sendErrorMessage(w, "addCard", err, "Error add new card to collection. Try again.")
 		return
 	}
-	newsLetter(w, "New card was added: "+card.Name+".")
+	if _, err := newsLetter(r.Context(), topicNewCards, "new_card", map[string]interface{}{"Card": card.Name}); err != nil {
+		logger.WithFields(logrus.Fields{
+			"action": "addCard",
+			"status": "error",
+			"error":  err.Error(),
+		}).Error("Error queueing newsletter")
+	}
 	sendSuccessMessage(w, "addCard", "New card added to collection successfully!", "")
 }
 func market(w http.ResponseWriter, r *http.Request) {
 	tokenString := r.URL.Query().Get("token")
-	token, err := verifyToken(tokenString)
-	claims, ok := token.Claims.(jwt.MapClaims)
-	if !ok {
-		logger.WithFields(logrus.Fields{
-			"action": "market",
-			"status": "error",
-			"error":  err,
-		}).Error("Failed to convert claims to jwt.Claims.")
-		r.URL.Path = "/"
-		return
-	}
-	userID, ok := claims["user_id"].(string)
+	identity, ok := identityFrom(r)
+	userID := identity.User_id
 	if !ok {
 		logger.WithFields(logrus.Fields{
 			"action": "collection",
@@ -506,7 +576,7 @@ func market(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	var deals []Card_in_deal
-	cursor, err := db.Collection("cards_in_deal").Find(r.Context(), bson.M{"user_id": userID}, options.Find().SetProjection(bson.M{"user_id": 1, "card_id": 1, "_id": 0}))
+	cursor, err := db.Collection("cards_in_deal").Find(r.Context(), bson.M{"user_id": userID}, options.Find().SetProjection(bson.M{"user_id": 1, "card_id": 1, "price": 1, "expires_at": 1, "_id": 0}))
 	if err != nil {
 		errorMessage := "User has not players in deals."
 		logger.WithFields(logrus.Fields{
@@ -549,118 +619,161 @@ func BsonToDeals(bsonData bson.M) (Deals, error) {
 	}
 	return deal, nil
 }
-func printData(w http.ResponseWriter, r *http.Request, cursor *mongo.Cursor) {
-	var deals []Deals
-	for cursor.Next(r.Context()) {
-		var bsonDoc bson.M
-		err := cursor.Decode(&bsonDoc)
-		if err != nil {
-			sendErrorMessage(w, "printData", err, "Error decoding database results. Try to reload page.")
-			return
-		}
-		deal, err := BsonToDeals(bsonDoc)
-		if err != nil {
-			sendErrorMessage(w, "printData", err, "Error converting data to Deals. Try to reload page.")
-			return
-		}
-		deals = append(deals, deal)
+func marketCards(w http.ResponseWriter, r *http.Request) {
+	_, perPage, err := parsePage(r.URL.Query())
+	if err != nil {
+		sendErrorMessage(w, "marketCards", err, "Invalid per_page parameter. Try to reload page.")
+		return
 	}
-	w.Header().Set("Content-Type", "application/json")
-	if err := json.NewEncoder(w).Encode(deals); err != nil {
-		sendErrorMessage(w, "printData", err, "Error encoding JSON. Try to reload page.")
+	positionFilter := r.URL.Query().Get("filter")
+	sortBy := r.URL.Query().Get("sort")
+	field, ok := marketCardsSortKeys[sortBy]
+	if !ok {
+		sendErrorMessage(w, "marketCards", errors.New("invalid sort key "+sortBy), "Invalid sort parameter. Try to reload page.")
 		return
 	}
-}
-func marketCards(w http.ResponseWriter, r *http.Request) {
-	var perPage = 20
-	page, err := strconv.Atoi(r.URL.Query().Get("page"))
+	order, err := parseOrder(r.URL.Query())
 	if err != nil {
-		sendErrorMessage(w, "marketCards", err, "Invalid page parameter. Try to reload page.")
+		sendErrorMessage(w, "marketCards", err, "Invalid order parameter. Try to reload page.")
 		return
 	}
-	skip := (page - 1) * perPage
+	filters := bson.A{activeListing()}
+	if positionFilter != "" {
+		filters = append(filters, bson.M{"card_id.position": positionFilter})
+	}
+	// Page numbers are kept for old callers, otherwise the cursor (or its absence) selects the page.
+	page := 0
+	var current *pageCursor
 	findOptions := options.Find()
-	findOptions.SetSkip(int64(skip))
-	findOptions.SetLimit(int64(perPage))
-	positionFilter := r.URL.Query().Get("filter")
-	sortBy := r.URL.Query().Get("sort")
-	if positionFilter == "" && sortBy == "card_id." {
-		cursor, err := db.Collection("cards_in_deal").Find(r.Context(), bson.D{}, findOptions)
-		if err != nil {
-			sendErrorMessage(w, "marketCards", err, "Error querying the database. Try to reload page.")
+	if value := r.URL.Query().Get("page"); value != "" {
+		page, err = strconv.Atoi(value)
+		if err != nil || page < 1 {
+			sendErrorMessage(w, "marketCards", errors.New("invalid page"), "Invalid page parameter. Try to reload page.")
 			return
 		}
-		defer cursor.Close(r.Context())
-		printData(w, r, cursor)
-		logger.WithFields(logrus.Fields{
-			"action": "marketCards",
-			"status": "success",
-			"page":   page,
-		}).Info("Data was printed")
-	} else if positionFilter == "" && sortBy != "card_id." {
-		sortOptions := bson.D{{Key: sortBy, Value: 1}}
-		findOptions.SetSort(sortOptions)
-		cursor, err := db.Collection("cards_in_deal").Find(r.Context(), bson.M{}, findOptions)
-		if err != nil {
-			sendErrorMessage(w, "marketCards", err, "Error querying the database. Try to reload page.")
+		findOptions.SetSkip(int64((page - 1) * perPage))
+	} else if value := r.URL.Query().Get("cursor"); value != "" {
+		cursor, err := decodeCursor(value)
+		if err != nil || cursor.Sort != field {
+			sendErrorMessage(w, "marketCards", errors.New("invalid cursor"), "Invalid cursor parameter. Try to reload page.")
 			return
 		}
-		defer cursor.Close(r.Context())
-		printData(w, r, cursor)
-		logger.WithFields(logrus.Fields{
-			"action": "marketCards",
-			"status": "success",
-			"page":   page,
-			"sortBy": sortBy,
-		}).Info("Data was sorted by " + sortBy)
-	} else if positionFilter != "" && sortBy == "card_id." {
-		filter := bson.M{"card_id.position": positionFilter}
-		cursor, err := db.Collection("cards_in_deal").Find(r.Context(), filter, findOptions)
-		if err != nil {
-			sendErrorMessage(w, "marketCards", err, "Error querying the database. Try to reload page.")
-			return
+		current = &cursor
+	}
+	backwards := current != nil && current.Before
+	queryOrder := order
+	if backwards {
+		queryOrder = -order
+	}
+	if current != nil {
+		filters = append(filters, afterCursor(*current, field, queryOrder))
+	}
+	filter := bson.M{}
+	if len(filters) > 0 {
+		filter = bson.M{"$and": filters}
+	}
+	sort := bson.D{{Key: field, Value: queryOrder}}
+	if field != "_id" {
+		sort = append(sort, bson.E{Key: "_id", Value: queryOrder})
+	}
+	findOptions.SetSort(sort)
+	findOptions.SetLimit(int64(perPage + 1))
+	cursor, err := db.Collection("cards_in_deal").Find(r.Context(), filter, findOptions)
+	if err != nil {
+		sendErrorMessage(w, "marketCards", err, "Error querying the database. Try to reload page.")
+		return
+	}
+	defer cursor.Close(r.Context())
+	var docs []bson.Raw
+	for cursor.Next(r.Context()) {
+		docs = append(docs, append(bson.Raw{}, cursor.Current...))
+	}
+	if err := cursor.Err(); err != nil {
+		sendErrorMessage(w, "marketCards", err, "Error decoding database results. Try to reload page.")
+		return
+	}
+	more := len(docs) > perPage
+	if more {
+		docs = docs[:perPage]
+	}
+	if backwards {
+		for i, j := 0, len(docs)-1; i < j; i, j = i+1, j-1 {
+			docs[i], docs[j] = docs[j], docs[i]
 		}
-		defer cursor.Close(r.Context())
-		printData(w, r, cursor)
-		logger.WithFields(logrus.Fields{
-			"action": "marketCards",
-			"status": "success",
-			"page":   page,
-			"filter": positionFilter,
-		}).Info("Data was filtered by " + positionFilter)
-	} else {
-		sortOptions := bson.D{{Key: sortBy, Value: 1}}
-		findOptions.SetSort(sortOptions)
-		filter := bson.M{"card_id.position": positionFilter}
-		cursor, err := db.Collection("cards_in_deal").Find(r.Context(), filter, findOptions)
-		if err != nil {
-			sendErrorMessage(w, "marketCards", err, "Error querying the database. Try to reload page.")
+	}
+	deals := []Deals{}
+	for _, doc := range docs {
+		var deal Deals
+		if err := bson.Unmarshal(doc, &deal); err != nil {
+			sendErrorMessage(w, "marketCards", err, "Error converting data to Deals. Try to reload page.")
 			return
 		}
-		defer cursor.Close(r.Context())
-		printData(w, r, cursor)
-		logger.WithFields(logrus.Fields{
-			"action": "marketCards",
-			"status": "success",
-			"page":   page,
-			"sortBy": sortBy,
-			"filter": positionFilter,
-		}).Info("Data was sorted by " + sortBy + " and filtered by " + positionFilter)
+		deals = append(deals, deal)
 	}
+	// Walking backwards the cursor item itself follows the page, walking forwards it precedes it.
+	hasNext := more || backwards
+	hasPrev := (backwards && more) || (!backwards && (current != nil || page > 1))
+	response := map[string]interface{}{
+		"items":    deals,
+		"per_page": perPage,
+		"next":     "",
+		"prev":     "",
+	}
+	if page > 0 {
+		response["page"] = page
+	}
+	if len(docs) > 0 {
+		if hasNext {
+			next, err := cursorFor(docs[len(docs)-1], field, false)
+			if err == nil {
+				response["next"], err = encodeCursor(next)
+			}
+			if err != nil {
+				sendErrorMessage(w, "marketCards", err, "Error creating next cursor. Try to reload page.")
+				return
+			}
+		}
+		if hasPrev {
+			prev, err := cursorFor(docs[0], field, true)
+			if err == nil {
+				response["prev"], err = encodeCursor(prev)
+			}
+			if err != nil {
+				sendErrorMessage(w, "marketCards", err, "Error creating previous cursor. Try to reload page.")
+				return
+			}
+		}
+	}
+	logger.WithFields(logrus.Fields{
+		"action": "marketCards",
+		"status": "success",
+		"page":   page,
+		"sortBy": sortBy,
+		"filter": positionFilter,
+	}).Info("Data was printed")
+	respondWithJSON(w, http.StatusOK, response)
 }
 func cardToCollection(w http.ResponseWriter, r *http.Request) {
-	userID := r.URL.Query().Get("user_id")
+	userID, err := actingUserID(r, "user_id")
+	if err != nil {
+		sendForbidden(w, "cardToCollection", err)
+		return
+	}
 	cardID := r.URL.Query().Get("card_id")
 	card_id, err := strconv.Atoi(cardID)
 	if err != nil {
 		sendErrorMessage(w, "cardToCollection", err, "Error converting card_id to int. Try again.")
 		return
 	}
-	_, err = db.Collection("cards_in_deal").DeleteOne(r.Context(), bson.M{"user_id": userID, "card_id.card_id": card_id})
+	result, err := db.Collection("cards_in_deal").DeleteOne(r.Context(), bson.M{"user_id": userID, "card_id.card_id": card_id})
 	if err != nil {
 		sendErrorMessage(w, "cardToCollection", err, "Error deleting card from deal. Try again.")
 		return
 	}
+	if result.DeletedCount == 0 {
+		sendErrorMessage(w, "cardToCollection", mongo.ErrNoDocuments, "The card is not on the market.")
+		return
+	}
 	var card Card
 	err = db.Collection("cards").FindOne(r.Context(), bson.M{"card_id": card_id}, options.FindOne().SetProjection(bson.M{"_id": 0})).Decode(&card)
 	if err != nil {
@@ -678,18 +791,8 @@ func cardToCollection(w http.ResponseWriter, r *http.Request) {
 }
 func collection(w http.ResponseWriter, r *http.Request) {
 	tokenString := r.URL.Query().Get("token")
-	token, err := verifyToken(tokenString)
-	claims, ok := token.Claims.(jwt.MapClaims)
-	if !ok {
-		logger.WithFields(logrus.Fields{
-			"action": "collection",
-			"status": "error",
-			"error":  err,
-		}).Error("Failed to convert claims to jwt.Claims.")
-		r.URL.Path = "/"
-		return
-	}
-	userID, ok := claims["user_id"].(string)
+	identity, ok := identityFrom(r)
+	userID := identity.User_id
 	if !ok {
 		logger.WithFields(logrus.Fields{
 			"action": "collection",
@@ -718,8 +821,16 @@ func collection(w http.ResponseWriter, r *http.Request) {
 			"error":  err.Error(),
 		}).Error(errorMessage)
 	}
+	progress, err := userSetsProgress(r.Context(), userID)
+	if err != nil {
+		logger.WithFields(logrus.Fields{
+			"action": "collection",
+			"status": "error",
+			"error":  err.Error(),
+		}).Error("Error getting sets progress.")
+	}
 	answer := []interface{}{
-		tokenString, collection,
+		tokenString, collection, progress,
 	}
 	logger.WithFields(logrus.Fields{
 		"action": "collection",
@@ -735,7 +846,11 @@ func saveTeam(w http.ResponseWriter, r *http.Request) {
 		sendErrorMessage(w, "saveTeam", err, "Failed to parse request body. Try to reload page.")
 		return
 	}
-	user_id := r.URL.Query().Get("user_id")
+	user_id, err := actingUserID(r, "user_id")
+	if err != nil {
+		sendForbidden(w, "saveTeam", err)
+		return
+	}
 	filter := bson.M{"user_id": user_id}
 	update := bson.M{"$set": bson.M{"teamPlayers": teamData}}
 	// Обновляем документ, соответствующий фильтру
@@ -750,10 +865,14 @@ func getTeam(w http.ResponseWriter, r *http.Request) {
 	type TeamPlayers struct {
 		Players []Player `bson:"teamPlayers"`
 	}
-	user_id := r.URL.Query().Get("user_id")
+	user_id, err := actingUserID(r, "user_id")
+	if err != nil {
+		sendForbidden(w, "getTeam", err)
+		return
+	}
 	var teamPlayers TeamPlayers
 	filter := bson.M{"user_id": user_id}
-	err := db.Collection("teams").FindOne(r.Context(), filter).Decode(&teamPlayers)
+	err = db.Collection("teams").FindOne(r.Context(), filter).Decode(&teamPlayers)
 	if err != nil {
 		sendErrorMessage(w, "getTeam", err, "Failed to fetch team data. Try to reload page.")
 		return
@@ -819,39 +938,6 @@ func addQuestion(w http.ResponseWriter, r *http.Request) {
 	questionChannel <- data
 	sendSuccessMessage(w, "addQuestion", "New question added to collection successfully!", "")
 }
-func newsLetter(w http.ResponseWriter, message string) {
-	var users []User
-	cursor, err := db.Collection("users").Find(context.TODO(), bson.M{})
-	if err != nil {
-		logger.WithFields(logrus.Fields{
-			"action": "newsLetter",
-			"status": "error",
-			"error":  err.Error(),
-		}).Error("Error fetching users")
-	}
-	if err := cursor.All(context.TODO(), &users); err != nil {
-		logger.WithFields(logrus.Fields{
-			"action": "newsLetter",
-			"status": "error",
-			"error":  err.Error(),
-		}).Error("Error decoding users")
-	}
-	for _, user := range users {
-		body := fmt.Sprint(message)
-		m := gomail.NewMessage()
-		m.SetHeader("From", "nurlanovernur33@gmail.com")
-		m.SetHeader("To", user.Email)
-		m.SetHeader("Subject", "Подтверждение почты")
-		m.SetBody("text/plain", body)
-		// Отправка письма
-		d := gomail.NewDialer("smtp.gmail.com", 587, "nurlanovernur33@gmail.com", "hlwa hlzl epre rhfd")
-		if err := d.DialAndSend(m); err != nil {
-			sendErrorMessage(w, "createUser", err, "Error send message. Try again.")
-			return
-		}
-	}
-}
-
 // /////////////////////////////////////////////////////////////////// Daily questions page
 func dailyQuestions(w http.ResponseWriter, r *http.Request) {
 	tmpl, err := template.ParseFiles("daily_card.html")
@@ -865,18 +951,8 @@ func dailyQuestions(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	tokenString := r.URL.Query().Get("token")
-	token, err := verifyToken(tokenString)
-	claims, ok := token.Claims.(jwt.MapClaims)
-	if !ok {
-		logger.WithFields(logrus.Fields{
-			"action": "dailyQuestions",
-			"status": "error",
-			"error":  err,
-		}).Error("Failed to convert claims to jwt.Claims.")
-		r.URL.Path = "/"
-		return
-	}
-	userID, ok := claims["user_id"].(string)
+	identity, ok := identityFrom(r)
+	userID := identity.User_id
 	if !ok {
 		logger.WithFields(logrus.Fields{
 			"action": "dailyQuestions",
@@ -919,29 +995,8 @@ func chatHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	tokenString := r.URL.Query().Get("token")
-	token, err := verifyToken(tokenString)
-	if err != nil {
-		logger.WithFields(logrus.Fields{
-			"action": "chatHandler",
-			"status": "error",
-			"error":  err.Error(),
-		}).Error("Error verifying token")
-		http.Error(w, "Unauthorized", http.StatusUnauthorized)
-		return
-	}
-
-	claims, ok := token.Claims.(jwt.MapClaims)
-	if !ok {
-		logger.WithFields(logrus.Fields{
-			"action": "chatHandler",
-			"status": "error",
-			"error":  err,
-		}).Error("Failed to convert claims to jwt.Claims.")
-		http.Error(w, "Unauthorized", http.StatusUnauthorized)
-		return
-	}
-
-	userID, ok := claims["user_id"].(string)
+	identity, ok := identityFrom(r)
+	userID := identity.User_id
 	if !ok {
 		logger.WithFields(logrus.Fields{
 			"action": "chatHandler",
@@ -977,251 +1032,205 @@ func chatHandler(w http.ResponseWriter, r *http.Request) {
 	}).Info("User on the chat page")
 	tmpl.ExecuteTemplate(w, "chat.html", data)
 }
+// allChats is the support queue, the open chats nobody handles, oldest first.
 func allChats(w http.ResponseWriter, r *http.Request) {
-	cursor, err := db.Collection("chats").Find(context.TODO(), bson.M{})
+	chats := []Chat{}
+	opts := options.Find().SetSort(queueOrder).SetProjection(bson.M{"messages": 0})
+	cursor, err := db.Collection("chats").Find(r.Context(), queuedFilter(), opts)
 	if err != nil {
 		sendErrorMessage(w, "allChats", err, "Failed to give all chats. Try again later.")
 		return
 	}
-	var chats []Chat
-	for cursor.Next(context.TODO()) {
-		var chat Chat
-		err := cursor.Decode(&chat)
-		if err != nil {
-			errorMessage := "Error getting chats"
-			logger.WithFields(logrus.Fields{
-				"action": "allChats",
-				"status": "error",
-				"error":  err.Error(),
-			}).Error(errorMessage)
-			return
-		}
-		if (!chat.Is_finished && chat.Id_support == "") {
-			chats = append(chats, chat)
-		}
+	if err := cursor.All(r.Context(), &chats); err != nil {
+		sendErrorMessage(w, "allChats", err, "Error getting chats. Try again later.")
+		return
 	}
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(map[string][]Chat{"chats": chats})
 }
 func myChats(w http.ResponseWriter, r *http.Request) {
-	id := r.URL.Query().Get("id")
-	cursor, err := db.Collection("chats").Find(context.TODO(), bson.M{"id_support": id})
+	id, err := actingAccountID(r, "id")
+	if err != nil {
+		sendForbidden(w, "myChats", err)
+		return
+	}
+	chats := []Chat{}
+	opts := options.Find().SetSort(bson.D{{Key: "assigned_at", Value: 1}}).SetProjection(bson.M{"messages": 0})
+	cursor, err := db.Collection("chats").Find(r.Context(), bson.M{"id_support": id, "is_finished": false}, opts)
 	if err != nil {
 		sendErrorMessage(w, "myChats", err, "Failed to give your chats. Try again later.")
 		return
 	}
-	var chats []Chat
-	for cursor.Next(context.TODO()) {
-		var chat Chat
-		err := cursor.Decode(&chat)
-		if err != nil {
-			errorMessage := "Error getting chats"
-			logger.WithFields(logrus.Fields{
-				"action": "myChats",
-				"status": "error",
-				"error":  err.Error(),
-			}).Error(errorMessage)
-			return
-		}
-		if (!chat.Is_finished) {
-			chats = append(chats, chat)
-		}
+	if err := cursor.All(r.Context(), &chats); err != nil {
+		sendErrorMessage(w, "myChats", err, "Error getting chats. Try again later.")
+		return
 	}
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(map[string][]Chat{"chats": chats})
 }
 func handleAdmin(w http.ResponseWriter, r *http.Request) {
-	id := r.URL.Query().Get("id")
-	chatId := r.URL.Query().Get("chat_id")
-	objID, err := primitive.ObjectIDFromHex(chatId)
+	id, err := actingAccountID(r, "id")
 	if err != nil {
-			sendErrorMessage(w, "handleAdmin", err, "Invalid chat ID.")
-			return
+		sendForbidden(w, "handleAdmin", err)
+		return
+	}
+	objID, err := primitive.ObjectIDFromHex(r.URL.Query().Get("chat_id"))
+	if err != nil {
+		sendErrorMessage(w, "handleAdmin", err, "Invalid chat ID.")
+		return
 	}
+	// chats are claimed from the queue first, only the assigned agent joins
+	filter := bson.M{"_id": objID, "is_finished": false, "id_support": id}
 	var chat Chat
-	filter := bson.M{"id_support": id, "is_finished": false}
-	error := db.Collection("chats").FindOne(r.Context(), filter)
-	if error != nil {
-		err = db.Collection("chats").FindOne(r.Context(), bson.M{"_id": objID}).Decode(&chat)
-		if err != nil {
-			sendErrorMessage(w, "handleAdmin", err, "Error getting chat. Try again.")
-			return
-		}
-		chat.Id_support = id
-		update := bson.M{"$set": bson.M{"id_support": chat.Id_support}}
-		_, err = db.Collection("chats").UpdateOne(r.Context(), bson.M{"_id": objID}, update)
-		if err != nil {
-			sendErrorMessage(w, "handleAdmin", err, "Error updating chat. Try again.")
-			return
-		}
+	err = db.Collection("chats").FindOne(r.Context(), filter, options.FindOne().SetProjection(bson.M{"messages": 0})).Decode(&chat)
+	if err == mongo.ErrNoDocuments {
+		sendErrorMessage(w, "handleAdmin", err, "The chat is finished or not claimed by you. Claim it from the queue first.")
+		return
+	}
+	if err != nil {
+		sendErrorMessage(w, "handleAdmin", err, "Error getting chat. Try again.")
+		return
 	}
-	conn, err := upgrader.Upgrade(w, r, nil)
+	ws, err := upgrader.Upgrade(w, r, nil)
 	if err != nil {
 		sendErrorMessage(w, "handleAdmin", errors.New("error create connect. try again"), "error create connect. try again")
 		return
 	}
-
-	mu.Lock()
-	adminConn = conn
-	mu.Unlock()
-
-	defer func() {
-		mu.Lock()
-		adminConn = nil
-		mu.Unlock()
-		conn.Close()
-	}()
+	conn := newChatConn(ws, chat.ID, chatRoleSupport)
+	chatRooms.join(conn)
+	defer chatRooms.leave(conn)
 
 	for {
-		_, msg, err := conn.ReadMessage()
+		_, msg, err := ws.ReadMessage()
 		if err != nil {
-			conn.Close()
-			sendErrorMessage(w, "handleAdmin", errors.New("error read message. try again"), "error read message. try again")
 			break
 		}
 		if string(msg) == "close" {
-			mu.Lock()
-			for userConn := range userConns {
-				if err := userConn.WriteMessage(websocket.TextMessage, []byte("close")); err != nil {
-					sendErrorMessage(w, "handleAdmin", errors.New("error write message. try again"), "error write message. try again")
-					userConn.Close()
-					delete(userConns, userConn)
-				}
-			}
-			mu.Unlock()
-			update := bson.M{"$set": bson.M{"is_finished": true}}
-			_, err = db.Collection("chats").UpdateOne(r.Context(), bson.M{"_id": objID}, update)
+			update := bson.M{"$set": bson.M{"is_finished": true, "finished_at": time.Now()}}
+			_, err = db.Collection("chats").UpdateOne(r.Context(), bson.M{"_id": objID, "id_support": id}, update)
 			if err != nil {
-				sendErrorMessage(w, "handleAdmin", err, "Error closing chat. Try again.")
-				return
+				logger.WithFields(logrus.Fields{
+					"action": "handleAdmin",
+					"status": "error",
+					"error":  err.Error(),
+				}).Error("Error closing chat")
+				break
 			}
-			conn.Close()
+			chatRooms.forward(conn, msg)
 			break
 		}
 		message := Message{
 			Sender:      id,
-			Role: 			 "admin",
+			Role:        chatRoleSupport,
 			MessageText: string(msg),
 			Timestamp:   time.Now(),
 		}
-
-		if err := saveMessage(chat.Id_client, message); err != nil {
-			conn.Close()
-			sendErrorMessage(w, "handleAdmin", err, err.Error())
+		if err := saveMessage(r.Context(), objID, message); err != nil {
+			logger.WithFields(logrus.Fields{
+				"action": "handleAdmin",
+				"status": "error",
+				"error":  err.Error(),
+			}).Error("Error saving message")
 			break
 		}
-
-		mu.Lock()
-		for userConn := range userConns {
-			if err := userConn.WriteMessage(websocket.TextMessage, msg); err != nil {
-				conn.Close()
-				sendErrorMessage(w, "handleAdmin", errors.New("error write message. try again"), "error write message. try again")
-				userConn.Close()
-				delete(userConns, userConn)
+		if chat.First_response_at.IsZero() {
+			if err := markFirstResponse(r.Context(), objID, message.Timestamp); err == nil {
+				chat.First_response_at = message.Timestamp
 			}
 		}
-		mu.Unlock()
+		chatRooms.forward(conn, msg)
+		notifyAccount(r.Context(), chat.Id_client, notifyChatReply, "Support replied: "+string(msg), "/chatHandler")
 	}
 }
 func handleUser(w http.ResponseWriter, r *http.Request) {
-	user_id := r.URL.Query().Get("id")
+	user_id, err := actingAccountID(r, "id")
+	if err != nil {
+		sendForbidden(w, "handleUser", err)
+		return
+	}
 	filter := bson.M{"id_client": user_id, "is_finished": false}
+	update := bson.M{"$setOnInsert": bson.M{"id_support": "", "messages": bson.A{}, "created_at": time.Now()}}
+	opts := options.FindOneAndUpdate().SetUpsert(true).SetReturnDocument(options.After)
 	var chat Chat
-	err := db.Collection("chats").FindOne(r.Context(), filter).Decode(&chat)
-	if err != nil && err != mongo.ErrNoDocuments {
-			sendErrorMessage(w, "handleUser", err, "Error finding chat")
-			return
+	err = db.Collection("chats").FindOneAndUpdate(r.Context(), filter, update, opts).Decode(&chat)
+	if err != nil {
+		sendErrorMessage(w, "handleUser", err, "Error finding chat")
+		return
 	}
-
-	if err == mongo.ErrNoDocuments {
-		chat := Chat{
-		Id_client: user_id,
-		Is_finished: false,
-		Messages:    []Message{},
-		}
-		_, err := db.Collection("chats").InsertOne(context.TODO(), chat)
-		if err != nil {
-			errorMessage := "error create chat. try again"
-			sendErrorMessage(w, "handleUser", errors.New(errorMessage), errorMessage)
-			return
-		}
+	objID, err := primitive.ObjectIDFromHex(chat.ID)
+	if err != nil {
+		sendErrorMessage(w, "handleUser", err, "Error finding chat")
+		return
 	}
-	conn, err := upgrader.Upgrade(w, r, nil)
+	ws, err := upgrader.Upgrade(w, r, nil)
 	if err != nil {
 		sendErrorMessage(w, "handleUser", errors.New("error create connect. try again"), "error create connect. try again")
 		return
 	}
-	mu.Lock()
-	userConns[conn] = true
-	mu.Unlock()
-
-	defer func() {
-		mu.Lock()
-		delete(userConns, conn)
-		mu.Unlock()
-		conn.Close()
-	}()
+	conn := newChatConn(ws, chat.ID, chatRoleUser)
+	chatRooms.join(conn)
+	defer chatRooms.leave(conn)
 
 	for {
-		_, msg, err := conn.ReadMessage()
-		if err != nil {
-			conn.Close()
-			sendErrorMessage(w, "handleUser", errors.New("error read message. try again"), "error read message. try again")
-			break
-		}
-		if string(msg) == "close" {
-			conn.Close()
+		_, msg, err := ws.ReadMessage()
+		if err != nil || string(msg) == "close" {
 			break
 		}
-
 		message := Message{
 			Sender:      user_id,
-			Role: 			 "user",
+			Role:        chatRoleUser,
 			MessageText: string(msg),
 			Timestamp:   time.Now(),
 		}
-
-		if err := saveMessage(user_id, message); err != nil {
-			conn.Close()
-			sendErrorMessage(w, "handleUser", err, err.Error())
+		if err := saveMessage(r.Context(), objID, message); err != nil {
+			logger.WithFields(logrus.Fields{
+				"action": "handleUser",
+				"status": "error",
+				"error":  err.Error(),
+			}).Error("Error saving message")
 			break
 		}
-
-		mu.Lock()
-		if adminConn != nil {
-			if err := adminConn.WriteMessage(websocket.TextMessage, msg); err != nil {
-				conn.Close()
-				sendErrorMessage(w, "handleUser", errors.New("error write message. try again"), "error write message. try again")
-				mu.Unlock()
-				continue
-			}
-		}
-		mu.Unlock()
+		chatRooms.forward(conn, msg)
 	}
 }
-func saveMessage(id_client string, msg Message) error {
-	filter := bson.M{"id_client": id_client,"is_finished": false}
+
+// saveMessage appends a message to an open chat.
+func saveMessage(ctx context.Context, chatID primitive.ObjectID, msg Message) error {
+	filter := bson.M{"_id": chatID, "is_finished": false}
 	update := bson.M{"$push": bson.M{"messages": msg}}
-	result, err := db.Collection("chats").UpdateOne(context.Background(), filter, update)
+	result, err := db.Collection("chats").UpdateOne(ctx, filter, update)
 	if err != nil {
 		return err
 	}
 	if result.MatchedCount == 0 {
-		return fmt.Errorf("no chat found with id_client: %s", id_client)
+		return fmt.Errorf("no open chat with id: %s", chatID.Hex())
 	}
 	return nil
 }
 func getChat(w http.ResponseWriter, r *http.Request) {
-	user_id := r.URL.Query().Get("id")
+	user_id, err := actingAccountID(r, "id")
+	if err != nil {
+		sendForbidden(w, "getChat", err)
+		return
+	}
 	role := r.URL.Query().Get("role")
 	var chat Chat
 	var filter bson.M
 	if role == "user" {
 		filter = bson.M{"id_client": user_id, "is_finished": false}
 	} else {
+		identity, _ := identityFrom(r)
+		if !hasPermission(identity.Roles, permSupport) {
+			sendForbidden(w, "getChat", errForbiddenUser)
+			return
+		}
 		filter = bson.M{"id_support": user_id, "is_finished": false}
+		// an agent handling several chats names the one to read
+		if chatID, err := primitive.ObjectIDFromHex(r.URL.Query().Get("chat_id")); err == nil {
+			filter["_id"] = chatID
+		}
 	}
-	err := db.Collection("chats").FindOne(r.Context(), filter).Decode(&chat)
+	err = db.Collection("chats").FindOne(r.Context(), filter).Decode(&chat)
 	if err != nil {
 		if err == mongo.ErrNoDocuments {
 			http.Error(w, "No active chat found for the user", http.StatusNotFound)
@@ -1249,7 +1258,11 @@ func getToken(w http.ResponseWriter, r *http.Request) {
 
 //
 func giveCard(w http.ResponseWriter, r *http.Request) {
-	user_id := r.URL.Query().Get("user_id")
+	user_id, err := actingUserID(r, "user_id")
+	if err != nil {
+		sendForbidden(w, "giveCard", err)
+		return
+	}
 	answers := r.URL.Query().Get("answers")
 	token := r.URL.Query().Get("token")
 	if answers == "5" {
@@ -1275,6 +1288,7 @@ func giveCard(w http.ResponseWriter, r *http.Request) {
 			sendErrorMessage(w, "giveCard", err, "Failed to submit the answers. Try submitting the answers again.")
 			return
 		}
+		notifyUser(r.Context(), user_id, notifyCardReceived, "You received the card "+card.Name+" for your daily answers.", "/collection")
 		sendSuccessMessage(w, "giveCard", "The card "+card.Name+" has been added to your collection successfully.", token)
 	} else {
 		_, err := db.Collection("user_questions").UpdateOne(r.Context(), bson.M{"user_id": user_id}, bson.M{"$set": bson.M{"submit": true}})
@@ -1366,27 +1380,8 @@ func homePage(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	tokenString := r.URL.Query().Get("token")
-	token, err := verifyToken(tokenString)
-	claims, ok := token.Claims.(jwt.MapClaims)
-	if !ok {
-		logger.WithFields(logrus.Fields{
-			"action": "homePage",
-			"status": "error",
-			"error":  err,
-		}).Error("Failed to convert claims to jwt.Claims.")
-		r.URL.Path = "/"
-		return
-	}
-	userID, ok := claims["user_id"].(string)
-	if !ok {
-		logger.WithFields(logrus.Fields{
-			"action": "homePage",
-			"status": "error",
-		}).Error("User unauthorized.")
-		r.URL.Path = "/"
-		return
-	}
-	email, ok := claims["email"].(string)
+	identity, ok := identityFrom(r)
+	userID := identity.User_id
 	if !ok {
 		logger.WithFields(logrus.Fields{
 			"action": "homePage",
@@ -1395,17 +1390,19 @@ func homePage(w http.ResponseWriter, r *http.Request) {
 		r.URL.Path = "/"
 		return
 	}
-	password, ok := claims["password"].(string)
-	if !ok {
+	var user User
+	err = db.Collection("users").FindOne(r.Context(), bson.M{"user_id": userID}).Decode(&user)
+	if err != nil {
 		logger.WithFields(logrus.Fields{
 			"action": "homePage",
 			"status": "error",
-		}).Error("User unauthorized.")
+			"error":  err.Error(),
+		}).Error("User not found.")
 		r.URL.Path = "/"
 		return
 	}
 	var answer []string
-	answer = append(answer, tokenString, userID, email, password)
+	answer = append(answer, tokenString, userID, user.Email)
 	tmpl.ExecuteTemplate(w, "homepage.html", answer)
 }
 func updateUser(w http.ResponseWriter, r *http.Request) {
@@ -1420,8 +1417,17 @@ func updateUser(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Invalid JSON format", http.StatusBadRequest)
 		return
 	}
-	objID, _ := primitive.ObjectIDFromHex(updatedUser.ID)
-	result, err := db.Collection("users").UpdateOne(r.Context(), bson.M{"_id": objID}, bson.M{"$set": updatedUser})
+	userID, err := actingUserID(r, "user_id")
+	if err != nil {
+		sendForbidden(w, "updateUser", err)
+		return
+	}
+	// roles are changed only through the admin roles API and passwords through changePassword
+	updatedUser.ID = ""
+	updatedUser.User_id = userID
+	updatedUser.Roles = nil
+	updatedUser.Password = ""
+	result, err := db.Collection("users").UpdateOne(r.Context(), bson.M{"user_id": userID}, bson.M{"$set": updatedUser})
 	if err != nil {
 		log.Fatal(err)
 		http.Error(w, "Error updating user", http.StatusInternalServerError)
@@ -1507,16 +1513,22 @@ func transactionPageHandler(w http.ResponseWriter, r *http.Request){
 	}).Info("User on the page.")
 	tmpl.Execute(w, "transaction.html")
 }
+// subscribeHandler records the subscription of the logged in user, the user_id of the form is ignored.
 func subscribeHandler(w http.ResponseWriter, r *http.Request) {
+	accountID, err := actingAccountID(r, "user_id")
+	if err != nil {
+		sendForbidden(w, "subscribeHandler", err)
+		return
+	}
 	var paymentForm PaymentForm
-	err := json.NewDecoder(r.Body).Decode(&paymentForm)
+	err = json.NewDecoder(r.Body).Decode(&paymentForm)
 	if err != nil {
 		sendErrorMessage(w, "subscribeHandler", err, "Error collecting data")
 		return
 	}
 	log.Printf("Received payment form: %+v", paymentForm)
 	transaction := Transaction{
-		UserID: 				paymentForm.UserID,	
+		UserID: 				accountID,	
 		CardNumber:     paymentForm.CardNumber,
 		ExpirationDate: paymentForm.ExpirationDate,
 		CVV:            paymentForm.CVV,
@@ -1530,12 +1542,29 @@ func subscribeHandler(w http.ResponseWriter, r *http.Request) {
 		sendErrorMessage(w, "subscribeHandler", err, "Error set data")
 		return
 	}
+	var user User
+	objID, _ := primitive.ObjectIDFromHex(accountID)
+	err = db.Collection("users").FindOne(r.Context(), bson.M{"_id": objID}).Decode(&user)
+	if err == nil {
+		err = refreshPackCredits(r.Context(), user.User_id)
+	}
+	if err != nil {
+		logger.WithFields(logrus.Fields{
+			"action": "subscribeHandler",
+			"status": "error",
+			"error":  err.Error(),
+		}).Error("Error granting pack credits")
+	}
 	sendSuccessMessage(w, "subscribeHandler", "Data collected successfully, check transactions page, status must be completed", "")
 }
 func transactions(w http.ResponseWriter, r *http.Request) {
-	user_id := r.URL.Query().Get("user_id")
+	user_id, err := actingAccountID(r, "user_id")
+	if err != nil {
+		sendForbidden(w, "transactions", err)
+		return
+	}
 	var transaction Transaction
-	err := db.Collection("transactions").FindOne(r.Context(), bson.M{"user_id": user_id}).Decode(&transaction)
+	err = db.Collection("transactions").FindOne(r.Context(), bson.M{"user_id": user_id}).Decode(&transaction)
 	if err != nil {
 		sendErrorMessage(w, "transactions", err, "Error getting data")
 		return
@@ -1544,18 +1573,27 @@ func transactions(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(map[string]Transaction{"transaction": transaction})
 }
 // JWT token
-func generateToken(user *User) (string, error) {
+func generateToken(user *User, session *Session) (string, error) {
+	key, ok := tokenKeys.Keys[tokenKeys.Active]
+	if !ok {
+		return "", errNoSigningKey
+	}
 	token := jwt.New(jwt.SigningMethodHS256)
+	token.Header["kid"] = tokenKeys.Active
 
+	now := time.Now()
 	claims := jwt.MapClaims{}
-	claims["user_id"] = user.User_id
-	claims["email"] = user.Email
-	claims["password"] = user.Password
-	claims["exp"] = time.Now().Add(time.Hour * 24).Unix()
+	claims["sub"] = user.User_id
+	claims["roles"] = userRoles(*user)
+	claims["iat"] = now.Unix()
+	claims["exp"] = now.Add(tokenLifetime).Unix()
+	claims["jti"] = newTokenID()
+	claims["sid"] = session.ID
+	claims["mfa"] = session.Mfa
 
 	token.Claims = claims
 
-	tokenString, err := token.SignedString([]byte("secret_key"))
+	tokenString, err := token.SignedString(key)
 	if err != nil {
 		return "", err
 	}
@@ -1563,29 +1601,59 @@ func generateToken(user *User) (string, error) {
 }
 func verifyToken(tokenString string) (*jwt.Token, error) {
 	token, err := jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
-		return []byte("secret_key"), nil
+		if token.Method != jwt.SigningMethodHS256 {
+			return nil, errors.New("unexpected signing method " + token.Method.Alg())
+		}
+		kid, _ := token.Header["kid"].(string)
+		key, ok := tokenKeys.Keys[kid]
+		if !ok {
+			return nil, errors.New("unknown signing key " + kid)
+		}
+		return key, nil
 	})
 	if err != nil {
 		return nil, err
 	}
+	claims, ok := token.Claims.(jwt.MapClaims)
+	if !ok || !claims.VerifyExpiresAt(time.Now().Unix(), true) {
+		return nil, errors.New("token has no valid expiry")
+	}
+	if sub, _ := claims["sub"].(string); sub == "" {
+		return nil, errors.New("token has no subject")
+	}
 	return token, nil
 }
 func authenticate(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		cookie, err := r.Cookie("auth-token")
-    if err != nil {
-        http.Error(w, "Unauthorized", http.StatusUnauthorized)
-        return
-    }
-
-    tokenString := cookie.Value
-		
+		tokenString, ok := requestToken(r)
 		token, err := verifyToken(tokenString)
-		if err != nil || !token.Valid {
+		if !ok || err != nil || !token.Valid {
+			// access tokens are short lived, renew it with the refresh token cookie
+			tokenString, err = renewAccessToken(w, r)
+			if err != nil && !ok {
+				http.Error(w, "Unauthorized", http.StatusUnauthorized)
+				return
+			}
+			if err == nil {
+				token, err = verifyToken(tokenString)
+			}
+			if err != nil {
+				http.Redirect(w, r, "/", http.StatusSeeOther)
+				return
+			}
+		}
+		claims, ok := token.Claims.(jwt.MapClaims)
+		if !ok {
+			http.Redirect(w, r, "/", http.StatusSeeOther)
+			return
+		}
+		active, err := sessionActive(r.Context(), identityFromClaims(claims).Session_id)
+		if err != nil || !active {
+			clearSessionCookies(w)
 			http.Redirect(w, r, "/", http.StatusSeeOther)
 			return
 		}
-		next.ServeHTTP(w, r)
+		next.ServeHTTP(w, r.WithContext(withIdentity(r.Context(), identityFromClaims(claims))))
 	})
 }
 
@@ -1594,58 +1662,264 @@ func respondWithJSON(w http.ResponseWriter, statusCode int, data interface{}) {
 	w.WriteHeader(statusCode)
 	json.NewEncoder(w).Encode(data)
 }
-func handler(w http.ResponseWriter, r *http.Request) {
-	if !limiter.Allow() {
-		<-time.Tick(1 * time.Second)
+
+// envInt reads an integer setting from the environment.
+func envInt(name string, def int) int {
+	value, err := strconv.Atoi(os.Getenv(name))
+	if err != nil {
+		return def
+	}
+	return value
+}
+
+// withTransaction runs fn in a MongoDB transaction, retrying it on transient errors.
+func withTransaction(ctx context.Context, fn func(sc mongo.SessionContext) error) error {
+	session, err := db.Client().StartSession()
+	if err != nil {
+		return err
+	}
+	defer session.EndSession(ctx)
+	_, err = session.WithTransaction(ctx, func(sc mongo.SessionContext) (interface{}, error) {
+		return nil, fn(sc)
+	})
+	return err
+}
+
+// Indexes
+func createIndexes(ctx context.Context) {
+	indexes := map[string][]mongo.IndexModel{
+		"wallets": {
+			{Keys: bson.D{{Key: "user_id", Value: 1}}, Options: options.Index().SetUnique(true)},
+		},
+		"ledger": {
+			{Keys: bson.D{{Key: "user_id", Value: 1}, {Key: "date", Value: -1}}},
+		},
+		"card_sets": {
+			{Keys: bson.D{{Key: "set_id", Value: 1}}, Options: options.Index().SetUnique(true)},
+		},
+		"cards": {
+			{Keys: bson.D{{Key: "rarity", Value: 1}}},
+		},
+		"users": {
+			{Keys: bson.D{{Key: "roles", Value: 1}}},
+			{Keys: bson.D{{Key: "email", Value: 1}}, Options: options.Index().SetUnique(true)},
+		},
+		"password_resets": {
+			{Keys: bson.D{{Key: "token_hash", Value: 1}}},
+			{Keys: bson.D{{Key: "user_id", Value: 1}}},
+			// one unused reset link per user, storeResetToken relies on it to throttle
+			{Keys: bson.D{{Key: "user_id", Value: 1}, {Key: "used", Value: 1}}, Options: options.Index().SetUnique(true).SetPartialFilterExpression(bson.M{"used": false})},
+			{Keys: bson.D{{Key: "expires_at", Value: 1}}, Options: options.Index().SetExpireAfterSeconds(0)},
+		},
+		"confirm_users": {
+			{Keys: bson.D{{Key: "email", Value: 1}}, Options: options.Index().SetUnique(true)},
+			{Keys: bson.D{{Key: "token_hash", Value: 1}}},
+			{Keys: bson.D{{Key: "expires_at", Value: 1}}, Options: options.Index().SetExpireAfterSeconds(0)},
+		},
+		"sessions": {
+			{Keys: bson.D{{Key: "user_id", Value: 1}, {Key: "last_used", Value: -1}}},
+			{Keys: bson.D{{Key: "expires_at", Value: 1}}, Options: options.Index().SetExpireAfterSeconds(0)},
+		},
+		"two_factor": {
+			{Keys: bson.D{{Key: "user_id", Value: 1}}, Options: options.Index().SetUnique(true)},
+		},
+		"campaigns": {
+			{Keys: bson.D{{Key: "status", Value: 1}, {Key: "created_at", Value: 1}}},
+		},
+		"outbox": {
+			{Keys: bson.D{{Key: "status", Value: 1}, {Key: "next_attempt", Value: 1}}},
+			{Keys: bson.D{{Key: "expires_at", Value: 1}}, Options: options.Index().SetExpireAfterSeconds(0)},
+		},
+		"login_failures": {
+			{Keys: bson.D{{Key: "last_failure", Value: -1}}},
+			{Keys: bson.D{{Key: "expires_at", Value: 1}}, Options: options.Index().SetExpireAfterSeconds(0)},
+		},
+		"login_challenges": {
+			{Keys: bson.D{{Key: "expires_at", Value: 1}}, Options: options.Index().SetExpireAfterSeconds(0)},
+		},
+		"collections": {
+			{Keys: bson.D{{Key: "user_id", Value: 1}}},
+		},
+		"cards_in_deal": {
+			{Keys: bson.D{{Key: "card_id.name", Value: "text"}}},
+			{Keys: bson.D{{Key: "card_id.position", Value: 1}, {Key: "price", Value: 1}}},
+			{Keys: bson.D{{Key: "card_id.club", Value: 1}, {Key: "price", Value: 1}}},
+			{Keys: bson.D{{Key: "card_id.nationality", Value: 1}, {Key: "price", Value: 1}}},
+			{Keys: bson.D{{Key: "user_id", Value: 1}}},
+			{Keys: bson.D{{Key: "price", Value: 1}}},
+			{Keys: bson.D{{Key: "expires_at", Value: 1}}},
+		},
+		"fee_schedules": {
+			{Keys: bson.D{{Key: "effective_from", Value: -1}}},
+		},
+		"expired_listings": {
+			{Keys: bson.D{{Key: "user_id", Value: 1}, {Key: "expired_at", Value: -1}}},
+		},
+		"watchlists": {
+			{Keys: bson.D{{Key: "user_id", Value: 1}, {Key: "card_id", Value: 1}}, Options: options.Index().SetUnique(true)},
+			{Keys: bson.D{{Key: "card_id", Value: 1}, {Key: "target_price", Value: 1}}},
+		},
+		"chats": {
+			{Keys: bson.D{{Key: "id_client", Value: 1}}, Options: options.Index().SetUnique(true).SetPartialFilterExpression(bson.M{"is_finished": false})},
+			{Keys: bson.D{{Key: "id_support", Value: 1}, {Key: "is_finished", Value: 1}}},
+			{Keys: bson.D{{Key: "is_finished", Value: 1}, {Key: "id_support", Value: 1}, {Key: "created_at", Value: 1}}},
+			{Keys: bson.D{{Key: "created_at", Value: 1}}},
+		},
+		"notifications": {
+			{Keys: bson.D{{Key: "user_id", Value: 1}, {Key: "date", Value: -1}}},
+			{Keys: bson.D{{Key: "user_id", Value: 1}, {Key: "read", Value: 1}}},
+		},
+		"sales": {
+			{Keys: bson.D{{Key: "card_id", Value: 1}, {Key: "date", Value: -1}}},
+			{Keys: bson.D{{Key: "date", Value: 1}}},
+		},
+		"price_stats": {
+			{Keys: bson.D{{Key: "card_id", Value: 1}}, Options: options.Index().SetUnique(true)},
+		},
+		"price_candles": {
+			{Keys: bson.D{{Key: "card_id", Value: 1}, {Key: "interval", Value: 1}, {Key: "start", Value: 1}}, Options: options.Index().SetUnique(true)},
+		},
+		"pack_types": {
+			{Keys: bson.D{{Key: "pack_id", Value: 1}}, Options: options.Index().SetUnique(true)},
+		},
+		"pack_openings": {
+			{Keys: bson.D{{Key: "user_id", Value: 1}, {Key: "date", Value: -1}}},
+		},
+		"pack_credits": {
+			{Keys: bson.D{{Key: "user_id", Value: 1}}, Options: options.Index().SetUnique(true)},
+		},
+		"set_claims": {
+			{Keys: bson.D{{Key: "user_id", Value: 1}, {Key: "set_id", Value: 1}}},
+		},
+	}
+	for name, models := range indexes {
+		_, err := db.Collection(name).Indexes().CreateMany(ctx, models)
+		if err != nil {
+			logger.WithFields(logrus.Fields{
+				"action":     "createIndexes",
+				"status":     "error",
+				"collection": name,
+				"error":      err.Error(),
+			}).Error("Error creating indexes")
+		}
 	}
 }
 func handleRequests() {
 	rtr := mux.NewRouter()
 	//  CRUD
-	rtr.HandleFunc("/getUserByID", getUserByID).Methods("GET")
-	rtr.HandleFunc("/updateUser", updateUser).Methods("PUT", "POST")
+	rtr.Handle("/getUserByID", authenticate(http.HandlerFunc(getUserByID))).Methods("GET")
+	rtr.Handle("/updateUser", authenticate(http.HandlerFunc(updateUser))).Methods("PUT", "POST")
 	// Registration page
 	rtr.HandleFunc("/createUser", createUser).Methods("POST")
 	rtr.HandleFunc("/login", login).Methods("POST")
+	rtr.HandleFunc("/loginVerify", loginVerify).Methods("POST")
+	rtr.Handle("/twoFactor", authenticate(http.HandlerFunc(twoFactorStatus))).Methods("GET")
+	rtr.Handle("/twoFactor/enroll", authenticate(http.HandlerFunc(enrollTwoFactor))).Methods("POST")
+	rtr.Handle("/twoFactor/confirm", authenticate(http.HandlerFunc(confirmTwoFactor))).Methods("POST")
+	rtr.Handle("/twoFactor/disable", authenticate(http.HandlerFunc(disableTwoFactor))).Methods("POST")
+	rtr.Handle("/twoFactorPolicy", requirePermission(permUsers, http.HandlerFunc(getTwoFactorPolicy))).Methods("GET")
+	rtr.Handle("/twoFactorPolicy", requirePermission(permUsers, http.HandlerFunc(setTwoFactorPolicy))).Methods("PUT")
+	rtr.Handle("/loginLockouts", requirePermission(permUsers, http.HandlerFunc(loginLockouts))).Methods("GET")
+	rtr.Handle("/loginLockouts", requirePermission(permUsers, http.HandlerFunc(clearLockout))).Methods("DELETE")
+	rtr.Handle("/outbox", requirePermission(permUsers, http.HandlerFunc(outbox))).Methods("GET")
+	rtr.Handle("/outbox/retry", requirePermission(permUsers, http.HandlerFunc(retryEmail))).Methods("POST")
+	rtr.Handle("/emailPreview", requirePermission(permContent, http.HandlerFunc(emailPreview))).Methods("GET")
+	rtr.Handle("/language", authenticate(http.HandlerFunc(setLanguage))).Methods("POST")
+	rtr.Handle("/emailPreferences", authenticate(http.HandlerFunc(getEmailPreferences))).Methods("GET")
+	rtr.Handle("/emailPreferences", authenticate(http.HandlerFunc(setEmailPreferences))).Methods("PUT")
+	rtr.HandleFunc("/unsubscribe", unsubscribePage).Methods("GET")
+	rtr.HandleFunc("/unsubscribe", unsubscribe).Methods("POST")
+	rtr.Handle("/campaigns", requirePermission(permSupport, http.HandlerFunc(campaigns))).Methods("GET")
+	rtr.HandleFunc("/refreshToken", refreshToken).Methods("POST")
+	rtr.Handle("/logout", authenticate(http.HandlerFunc(logout))).Methods("POST")
+	rtr.Handle("/logoutAll", authenticate(http.HandlerFunc(logoutAll))).Methods("POST")
+	rtr.Handle("/sessions", authenticate(http.HandlerFunc(sessions))).Methods("GET")
+	rtr.Handle("/sessions", authenticate(http.HandlerFunc(revokeSession))).Methods("DELETE")
 	rtr.HandleFunc("/", registerPage).Methods("GET")
 	rtr.HandleFunc("/confirmPage", confirmPage)
 	rtr.HandleFunc("/confirm", confirm)
+	rtr.HandleFunc("/resendVerification", resendVerification).Methods("POST")
+	rtr.HandleFunc("/forgotPassword", forgotPassword).Methods("POST")
+	rtr.HandleFunc("/resetPage", resetPage).Methods("GET")
+	rtr.HandleFunc("/resetPassword", resetPassword).Methods("POST")
+	rtr.Handle("/changePassword", authenticate(http.HandlerFunc(changePassword))).Methods("POST")
 	// Market page
 	rtr.Handle("/market", authenticate(http.HandlerFunc(market))).Methods("GET")
 	rtr.HandleFunc("/marketCards", marketCards).Methods("GET")
-	rtr.HandleFunc("/cardToCollection", cardToCollection).Methods("POST")
+	rtr.HandleFunc("/marketSearch", marketSearch).Methods("GET")
+	rtr.Handle("/cardToCollection", authenticate(http.HandlerFunc(cardToCollection))).Methods("POST")
+	rtr.Handle("/listCard", authenticate(http.HandlerFunc(listCard))).Methods("POST")
+	rtr.Handle("/buyCard", authenticate(http.HandlerFunc(buyCard))).Methods("POST")
+	rtr.Handle("/expiredListings", authenticate(http.HandlerFunc(expiredListings))).Methods("GET")
+	rtr.Handle("/relistCard", authenticate(http.HandlerFunc(relistCard))).Methods("POST")
+	rtr.HandleFunc("/cardSales", cardSales).Methods("GET")
+	rtr.HandleFunc("/marketAnalytics", marketAnalytics).Methods("GET")
+	rtr.Handle("/watchlist", authenticate(http.HandlerFunc(watchlist))).Methods("GET")
+	rtr.Handle("/watchlist", authenticate(http.HandlerFunc(addWatch))).Methods("POST")
+	rtr.Handle("/watchlist", authenticate(http.HandlerFunc(updateWatch))).Methods("PUT")
+	rtr.Handle("/watchlist", authenticate(http.HandlerFunc(deleteWatch))).Methods("DELETE")
+	rtr.Handle("/notifications", authenticate(http.HandlerFunc(notifications))).Methods("GET")
+	rtr.Handle("/notifications/unread", authenticate(http.HandlerFunc(unreadNotifications))).Methods("GET")
+	rtr.Handle("/notifications/read", authenticate(http.HandlerFunc(readNotifications))).Methods("POST")
+	rtr.Handle("/notifications/ws", authenticate(http.HandlerFunc(notificationSocket))).Methods("GET")
 	// Admin page
-	rtr.Handle("/admin", authenticate(http.HandlerFunc(admin)))
-	rtr.HandleFunc("/addCard", addCard)
-	rtr.HandleFunc("/addQuestion", addQuestion)
-	rtr.HandleFunc("/allChats", allChats)
-	rtr.HandleFunc("/myChats", myChats)
-	rtr.HandleFunc("/deleteUser", deleteUser).Methods("DELETE")
+	rtr.Handle("/admin", requirePermission(permAdminPage, http.HandlerFunc(admin)))
+	rtr.Handle("/addCard", requirePermission(permContent, http.HandlerFunc(addCard)))
+	rtr.Handle("/addQuestion", requirePermission(permContent, http.HandlerFunc(addQuestion)))
+	rtr.Handle("/allChats", requirePermission(permSupport, http.HandlerFunc(allChats)))
+	rtr.Handle("/myChats", requirePermission(permSupport, http.HandlerFunc(myChats)))
+	rtr.Handle("/supportQueue/claim", requirePermission(permSupport, http.HandlerFunc(claimQueuedChat))).Methods("POST")
+	rtr.Handle("/supportQueue/release", requirePermission(permSupport, http.HandlerFunc(releaseQueuedChat))).Methods("POST")
+	rtr.Handle("/supportQueue/transfer", requirePermission(permSupport, http.HandlerFunc(transferQueuedChat))).Methods("POST")
+	rtr.Handle("/supportAgents", requirePermission(permUsers, http.HandlerFunc(setAgentLimit))).Methods("POST")
+	rtr.Handle("/supportMetrics", requirePermission(permUsers, http.HandlerFunc(supportMetrics))).Methods("GET")
+	rtr.Handle("/deleteUser", requirePermission(permUsers, http.HandlerFunc(deleteUser))).Methods("DELETE")
+	rtr.Handle("/userRoles", requirePermission(permUsers, http.HandlerFunc(getUserRoles))).Methods("GET")
+	rtr.Handle("/userRoles", requirePermission(permUsers, http.HandlerFunc(grantRole))).Methods("POST")
+	rtr.Handle("/userRoles", requirePermission(permUsers, http.HandlerFunc(revokeRole))).Methods("DELETE")
+	rtr.Handle("/addSet", requirePermission(permContent, http.HandlerFunc(addSet))).Methods("POST")
+	rtr.Handle("/addPackType", requirePermission(permContent, http.HandlerFunc(addPackType))).Methods("POST")
+	rtr.Handle("/feeSchedules", requirePermission(permEconomy, http.HandlerFunc(feeSchedules))).Methods("GET")
+	rtr.Handle("/feeSchedules", requirePermission(permEconomy, http.HandlerFunc(addFeeSchedule))).Methods("POST")
+	rtr.Handle("/marketFees", requirePermission(permEconomy, http.HandlerFunc(marketFees))).Methods("GET")
 	// Collection page
 	rtr.Handle("/collection", authenticate(http.HandlerFunc(collection))).Methods("GET")
-	rtr.HandleFunc("/saveTeam", saveTeam)
-	rtr.HandleFunc("/getTeam", getTeam)
+	rtr.Handle("/saveTeam", authenticate(http.HandlerFunc(saveTeam)))
+	rtr.Handle("/getTeam", authenticate(http.HandlerFunc(getTeam)))
 	rtr.HandleFunc("/get-auth-token", getToken)
+	rtr.Handle("/collectionCards", authenticate(http.HandlerFunc(collectionCards))).Methods("GET")
+	rtr.Handle("/sets", authenticate(http.HandlerFunc(sets))).Methods("GET")
+	rtr.Handle("/claimSet", authenticate(http.HandlerFunc(claimSet))).Methods("POST")
+	rtr.Handle("/wallet", authenticate(http.HandlerFunc(getWallet))).Methods("GET")
+	rtr.Handle("/duplicates", authenticate(http.HandlerFunc(duplicates))).Methods("GET")
+	rtr.Handle("/quickSell", authenticate(http.HandlerFunc(quickSell))).Methods("POST")
+	rtr.Handle("/craftCards", authenticate(http.HandlerFunc(craftCards))).Methods("POST")
+	// Packs
+	rtr.HandleFunc("/packs", packTypes).Methods("GET")
+	rtr.Handle("/buyPack", authenticate(http.HandlerFunc(buyPack))).Methods("POST")
+	rtr.Handle("/packHistory", authenticate(http.HandlerFunc(packHistory))).Methods("GET")
+	rtr.Handle("/packCredits", authenticate(http.HandlerFunc(packCredits))).Methods("GET")
 	// Daily cards page
 	rtr.Handle("/dailyQuestions", authenticate(http.HandlerFunc(dailyQuestions)))
-	rtr.HandleFunc("/giveCard", giveCard)
+	rtr.Handle("/giveCard", authenticate(http.HandlerFunc(giveCard)))
 	// Home page
 	rtr.Handle("/homePage", authenticate(http.HandlerFunc(homePage))).Methods("GET")
 	// Chat Page
-	rtr.HandleFunc("/handleAdmin", handleAdmin)
-	rtr.HandleFunc("/handleUser", handleUser)
-	rtr.HandleFunc("/getChat", getChat)
+	rtr.Handle("/handleAdmin", requirePermission(permSupport, http.HandlerFunc(handleAdmin)))
+	rtr.Handle("/handleUser", authenticate(http.HandlerFunc(handleUser)))
+	rtr.Handle("/getChat", authenticate(http.HandlerFunc(getChat)))
 	rtr.Handle("/chatHandler", authenticate(http.HandlerFunc(chatHandler))).Methods("GET")
 	// Transaction
-	rtr.HandleFunc("/subscribe", subscribeHandler)
+	rtr.Handle("/subscribe", authenticate(http.HandlerFunc(subscribeHandler))).Methods("POST")
 	// rtr.Handle("/paymentForm",  authenticate(http.HandlerFunc(paymentFormHandler)))
 	rtr.Handle("/transactionPage", authenticate(http.HandlerFunc(transactionPageHandler)))
-	rtr.HandleFunc("/transactions", transactions)
+	rtr.Handle("/transactions", authenticate(http.HandlerFunc(transactions)))
 	//
 	http.Handle("/css/", http.StripPrefix("/css/", http.FileServer(http.Dir("./css"))))
 	http.Handle("/script/", http.StripPrefix("/script/", http.FileServer(http.Dir("./script"))))
 	http.Handle("/images/", http.StripPrefix("/images/", http.FileServer(http.Dir("./images"))))
-	rtr.HandleFunc("/", handler)
+	rtr.Use(rateLimit)
+	go evictIdleBuckets()
 	http.Handle("/", rtr)
 	fmt.Println("Server listening on port 8080")
 	http.ListenAndServe(":8080", nil)
@@ -1659,8 +1933,19 @@ func main() {
 	}
 	defer client.Disconnect(context.TODO())
 	db = client.Database("Football_Manager")
+	tokenKeys = loadSigningKeys()
 	//
 	ctx := context.Background()
+	createIndexes(ctx)
+	ensureAdmin(ctx)
+	ensureTwoFactorPolicy(ctx)
+	mailer = loadMailer()
+	startMailWorkers(ctx)
+	expireLegacyConfirmations(ctx)
+	backfillChatCreatedAt(ctx)
 	go updateCollectionPeriodically(ctx)
+	go aggregatePricesPeriodically(ctx)
+	setMissingExpiry(ctx)
+	go sweepExpiredListings(ctx)
 	handleRequests()
 }
@@ -0,0 +1,274 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Price analytics
+type PricePoint struct {
+	Price int       `json:"price"`
+	Date  time.Time `json:"date"`
+}
+type PriceWindow struct {
+	Average float64 `json:"average"`
+	Median  float64 `json:"median"`
+	Min     int     `json:"min"`
+	Max     int     `json:"max"`
+	Volume  int     `json:"volume"`
+}
+type PriceStats struct {
+	Card_id    int                    `json:"card_id"`
+	Last_sale  *PricePoint            `json:"last_sale"`
+	Windows    map[string]PriceWindow `json:"windows"`
+	Updated_at time.Time              `json:"updated_at"`
+}
+type PriceCandle struct {
+	Card_id  int       `json:"card_id"`
+	Interval string    `json:"interval"`
+	Start    time.Time `json:"start"`
+	Open     int       `json:"open"`
+	High     int       `json:"high"`
+	Low      int       `json:"low"`
+	Close    int       `json:"close"`
+	Volume   int       `json:"volume"`
+}
+
+var priceWindows = []struct {
+	Name     string
+	Duration time.Duration
+}{
+	{"24h", 24 * time.Hour},
+	{"7d", 7 * 24 * time.Hour},
+	{"30d", 30 * 24 * time.Hour},
+}
+var candleIntervals = map[string]time.Duration{
+	"hour": time.Hour,
+	"day":  24 * time.Hour,
+}
+var priceStatsInterval = time.Duration(envInt("PRICE_STATS_INTERVAL_MINUTES", 10)) * time.Minute
+
+// priceWindow summarizes the sales made since the given time.
+func priceWindow(points []PricePoint, since time.Time) PriceWindow {
+	var prices []int
+	for _, point := range points {
+		if !point.Date.Before(since) {
+			prices = append(prices, point.Price)
+		}
+	}
+	var window PriceWindow
+	if len(prices) == 0 {
+		return window
+	}
+	sort.Ints(prices)
+	sum := 0
+	for _, price := range prices {
+		sum += price
+	}
+	n := len(prices)
+	window.Volume = n
+	window.Average = float64(sum) / float64(n)
+	window.Min = prices[0]
+	window.Max = prices[n-1]
+	if n%2 == 1 {
+		window.Median = float64(prices[n/2])
+	} else {
+		window.Median = float64(prices[n/2-1]+prices[n/2]) / 2
+	}
+	return window
+}
+func computePriceStats(ctx context.Context, now time.Time) error {
+	since := now.Add(-priceWindows[len(priceWindows)-1].Duration)
+	cursor, err := db.Collection("sales").Aggregate(ctx, mongo.Pipeline{
+		{{Key: "$match", Value: bson.M{"date": bson.M{"$gte": since}}}},
+		{{Key: "$sort", Value: bson.M{"date": 1}}},
+		{{Key: "$group", Value: bson.M{
+			"_id":    "$card_id",
+			"points": bson.M{"$push": bson.M{"price": "$price", "date": "$date"}},
+		}}},
+	})
+	if err != nil {
+		return err
+	}
+	var groups []struct {
+		Card_id int          `bson:"_id"`
+		Points  []PricePoint `bson:"points"`
+	}
+	if err := cursor.All(ctx, &groups); err != nil {
+		return err
+	}
+	for _, group := range groups {
+		windows := make(map[string]PriceWindow)
+		for _, window := range priceWindows {
+			windows[window.Name] = priceWindow(group.Points, now.Add(-window.Duration))
+		}
+		update := bson.M{"$set": bson.M{"windows": windows, "updated_at": now}}
+		_, err := db.Collection("price_stats").UpdateOne(ctx, bson.M{"card_id": group.Card_id}, update, options.Update().SetUpsert(true))
+		if err != nil {
+			return err
+		}
+	}
+	// cards without sales in the last 30 days keep only their last sale
+	_, err = db.Collection("price_stats").UpdateMany(ctx, bson.M{"updated_at": bson.M{"$ne": now}}, bson.M{"$set": bson.M{"windows": bson.M{}, "updated_at": now}})
+	return err
+}
+
+// computeCandles rebuilds the OHLC candles of every bucket starting at or after since.
+func computeCandles(ctx context.Context, since time.Time) error {
+	for interval, duration := range candleIntervals {
+		start := since.UTC().Truncate(duration)
+		cursor, err := db.Collection("sales").Aggregate(ctx, mongo.Pipeline{
+			{{Key: "$match", Value: bson.M{"date": bson.M{"$gte": start}}}},
+			{{Key: "$sort", Value: bson.M{"date": 1}}},
+			{{Key: "$group", Value: bson.M{
+				"_id": bson.M{
+					"card_id": "$card_id",
+					"start":   bson.M{"$dateTrunc": bson.M{"date": "$date", "unit": interval}},
+				},
+				"open":   bson.M{"$first": "$price"},
+				"high":   bson.M{"$max": "$price"},
+				"low":    bson.M{"$min": "$price"},
+				"close":  bson.M{"$last": "$price"},
+				"volume": bson.M{"$sum": 1},
+			}}},
+			{{Key: "$project", Value: bson.M{
+				"_id":      0,
+				"card_id":  "$_id.card_id",
+				"start":    "$_id.start",
+				"interval": interval,
+				"open":     1,
+				"high":     1,
+				"low":      1,
+				"close":    1,
+				"volume":   1,
+			}}},
+			{{Key: "$merge", Value: bson.M{
+				"into":           "price_candles",
+				"on":             bson.A{"card_id", "interval", "start"},
+				"whenMatched":    "replace",
+				"whenNotMatched": "insert",
+			}}},
+		})
+		if err != nil {
+			return err
+		}
+		cursor.Close(ctx)
+	}
+	return nil
+}
+func updateLastSales(ctx context.Context, since time.Time) error {
+	cursor, err := db.Collection("sales").Aggregate(ctx, mongo.Pipeline{
+		{{Key: "$match", Value: bson.M{"date": bson.M{"$gte": since}}}},
+		{{Key: "$sort", Value: bson.M{"date": 1}}},
+		{{Key: "$group", Value: bson.M{
+			"_id":   "$card_id",
+			"price": bson.M{"$last": "$price"},
+			"date":  bson.M{"$last": "$date"},
+		}}},
+	})
+	if err != nil {
+		return err
+	}
+	var last []struct {
+		Card_id int       `bson:"_id"`
+		Price   int       `bson:"price"`
+		Date    time.Time `bson:"date"`
+	}
+	if err := cursor.All(ctx, &last); err != nil {
+		return err
+	}
+	for _, sale := range last {
+		update := bson.M{"$set": bson.M{"last_sale": PricePoint{Price: sale.Price, Date: sale.Date}}}
+		_, err := db.Collection("price_stats").UpdateOne(ctx, bson.M{"card_id": sale.Card_id}, update, options.Update().SetUpsert(true))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// aggregatePricesPeriodically keeps price_stats and price_candles up to date.
+// The first run rebuilds everything, later runs only the recent buckets.
+func aggregatePricesPeriodically(ctx context.Context) {
+	var since time.Time
+	for {
+		now := time.Now()
+		err := updateLastSales(ctx, since)
+		if err == nil {
+			err = computePriceStats(ctx, now)
+		}
+		if err == nil {
+			err = computeCandles(ctx, since)
+		}
+		if err != nil {
+			logger.WithFields(logrus.Fields{
+				"action": "aggregatePricesPeriodically",
+				"status": "error",
+				"error":  err.Error(),
+			}).Error("Error aggregating market prices")
+		} else {
+			// a day back covers the bucket that was open during the previous run
+			since = now.Add(-24 * time.Hour)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(priceStatsInterval):
+		}
+	}
+}
+func marketAnalytics(w http.ResponseWriter, r *http.Request) {
+	cardID, err := strconv.Atoi(r.URL.Query().Get("card_id"))
+	if err != nil {
+		sendErrorMessage(w, "marketAnalytics", err, "Invalid card_id parameter. Try again.")
+		return
+	}
+	interval := r.URL.Query().Get("interval")
+	if interval == "" {
+		interval = "day"
+	}
+	duration, ok := candleIntervals[interval]
+	if !ok {
+		sendErrorMessage(w, "marketAnalytics", errors.New("invalid input"), "Invalid interval. Interval must be hour or day.")
+		return
+	}
+	points := 30
+	if value := r.URL.Query().Get("points"); value != "" {
+		points, err = strconv.Atoi(value)
+		if err != nil || points < 1 || points > 500 {
+			sendErrorMessage(w, "marketAnalytics", errors.New("invalid input"), "Invalid points. Points must be between 1 and 500.")
+			return
+		}
+	}
+	stats := PriceStats{Card_id: cardID, Windows: map[string]PriceWindow{}}
+	err = db.Collection("price_stats").FindOne(r.Context(), bson.M{"card_id": cardID}).Decode(&stats)
+	if err != nil && err != mongo.ErrNoDocuments {
+		sendErrorMessage(w, "marketAnalytics", err, "Error getting price statistics. Try to reload page.")
+		return
+	}
+	since := time.Now().UTC().Truncate(duration).Add(-time.Duration(points-1) * duration)
+	candles := []PriceCandle{}
+	cursor, err := db.Collection("price_candles").Find(r.Context(), bson.M{"card_id": cardID, "interval": interval, "start": bson.M{"$gte": since}}, options.Find().SetSort(bson.D{{Key: "start", Value: 1}}))
+	if err != nil {
+		sendErrorMessage(w, "marketAnalytics", err, "Error getting price history. Try to reload page.")
+		return
+	}
+	if err := cursor.All(r.Context(), &candles); err != nil {
+		sendErrorMessage(w, "marketAnalytics", err, "Error decoding price history. Try to reload page.")
+		return
+	}
+	respondWithJSON(w, http.StatusOK, map[string]interface{}{
+		"status":  "success",
+		"stats":   stats,
+		"candles": candles,
+	})
+}
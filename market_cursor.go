@@ -0,0 +1,96 @@
+package main
+
+import (
+	"encoding/base64"
+	"errors"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/bsontype"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Cursor pagination
+type pageCursor struct {
+	Sort  string             `bson:"sort"`
+	Value bson.RawValue      `bson:"value"`
+	ID    primitive.ObjectID `bson:"id"`
+	// Before marks a cursor that pages backwards from the item.
+	Before bool `bson:"before"`
+}
+
+// marketCardsSortKeys whitelists the sort parameter of marketCards, "card_id." is the unsorted default of the market page.
+var marketCardsSortKeys = map[string]string{
+	"":                    "_id",
+	"card_id.":            "_id",
+	"card_id.card_id":     "card_id.card_id",
+	"card_id.name":        "card_id.name",
+	"card_id.club":        "card_id.club",
+	"card_id.nationality": "card_id.nationality",
+	"card_id.position":    "card_id.position",
+	"price":               "price",
+}
+
+func encodeCursor(cursor pageCursor) (string, error) {
+	data, err := bson.Marshal(cursor)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(data), nil
+}
+func decodeCursor(value string) (pageCursor, error) {
+	var cursor pageCursor
+	data, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil {
+		return cursor, errors.New("invalid cursor")
+	}
+	if err := bson.Unmarshal(data, &cursor); err != nil {
+		return cursor, errors.New("invalid cursor")
+	}
+	return cursor, nil
+}
+
+// cursorFor builds the cursor pointing at the raw document doc.
+func cursorFor(doc bson.Raw, field string, before bool) (pageCursor, error) {
+	cursor := pageCursor{Sort: field, Before: before, Value: bson.RawValue{Type: bsontype.Null}}
+	id, ok := doc.Lookup("_id").ObjectIDOK()
+	if !ok {
+		return cursor, errors.New("document has no object id")
+	}
+	cursor.ID = id
+	if field != "_id" {
+		if value, err := doc.LookupErr(strings.Split(field, ".")...); err == nil {
+			cursor.Value = value
+		}
+	}
+	return cursor, nil
+}
+
+// afterCursor matches the documents that come after the cursor when sorting
+// by field and _id in the given order. Missing values sort first ascending.
+func afterCursor(cursor pageCursor, field string, order int) bson.M {
+	op := "$gt"
+	if order < 0 {
+		op = "$lt"
+	}
+	if field == "_id" {
+		return bson.M{"_id": bson.M{op: cursor.ID}}
+	}
+	if cursor.Value.Type == bsontype.Null || cursor.Value.Type == 0 {
+		if order > 0 {
+			return bson.M{"$or": bson.A{
+				bson.M{field: nil, "_id": bson.M{op: cursor.ID}},
+				bson.M{field: bson.M{"$ne": nil}},
+			}}
+		}
+		return bson.M{field: nil, "_id": bson.M{op: cursor.ID}}
+	}
+	or := bson.A{
+		bson.M{field: bson.M{op: cursor.Value}},
+		bson.M{field: cursor.Value, "_id": bson.M{op: cursor.ID}},
+	}
+	if order < 0 {
+		or = append(or, bson.M{field: nil})
+	}
+	return bson.M{"$or": or}
+}
@@ -0,0 +1,271 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// Market search
+type marketQuery struct {
+	Text        string
+	Club        []string
+	Nationality []string
+	Position    []string
+	Rarity      []string
+	Seller      []string
+	MinPrice    int
+	MaxPrice    int
+	Sort        string
+	Order       int
+	Page        int
+	PerPage     int
+}
+
+var marketSortKeys = map[string]string{
+	"name":        "card_id.name",
+	"card_id":     "card_id.card_id",
+	"club":        "card_id.club",
+	"nationality": "card_id.nationality",
+	"position":    "card_id.position",
+	"rarity":      "rarity_rank",
+	"price":       "price",
+	"relevance":   "score",
+}
+var marketFacets = map[string]string{
+	"club":        "$card_id.club",
+	"nationality": "$card_id.nationality",
+	"position":    "$card_id.position",
+	"rarity":      "$card_id.rarity",
+}
+
+// multiValue accepts both repeated parameters and comma separated lists.
+func multiValue(values url.Values, key string) []string {
+	var result []string
+	for _, value := range values[key] {
+		for _, part := range strings.Split(value, ",") {
+			if part = strings.TrimSpace(part); part != "" {
+				result = append(result, part)
+			}
+		}
+	}
+	return result
+}
+func parseMarketQuery(values url.Values) (marketQuery, error) {
+	query := marketQuery{
+		Text:        strings.TrimSpace(values.Get("q")),
+		Club:        multiValue(values, "club"),
+		Nationality: multiValue(values, "nationality"),
+		Position:    multiValue(values, "position"),
+		Rarity:      multiValue(values, "rarity"),
+		Seller:      multiValue(values, "seller"),
+		MaxPrice:    -1,
+		Sort:        values.Get("sort"),
+	}
+	if query.Sort == "" {
+		query.Sort = "card_id"
+		if query.Text != "" {
+			query.Sort = "relevance"
+		}
+	}
+	if _, ok := marketSortKeys[query.Sort]; !ok {
+		return query, errors.New("invalid sort key " + query.Sort)
+	}
+	if query.Sort == "relevance" && query.Text == "" {
+		return query, errors.New("sort by relevance needs a search text")
+	}
+	for _, rarity := range query.Rarity {
+		if !validRarity(rarity) {
+			return query, errors.New("invalid rarity " + rarity)
+		}
+	}
+	if value := values.Get("min_price"); value != "" {
+		price, err := strconv.Atoi(value)
+		if err != nil || price < 0 {
+			return query, errors.New("invalid min_price")
+		}
+		query.MinPrice = price
+	}
+	if value := values.Get("max_price"); value != "" {
+		price, err := strconv.Atoi(value)
+		if err != nil || price < query.MinPrice {
+			return query, errors.New("invalid max_price")
+		}
+		query.MaxPrice = price
+	}
+	var err error
+	query.Order, err = parseOrder(values)
+	if err != nil {
+		return query, err
+	}
+	if query.Sort == "relevance" {
+		// text score is only meaningful from best to worst
+		query.Order = -1
+	}
+	query.Page, query.PerPage, err = parsePage(values)
+	return query, err
+}
+func inFilter(values []string) interface{} {
+	if len(values) == 1 {
+		return values[0]
+	}
+	return bson.M{"$in": values}
+}
+
+// marketBaseFilter is the part of the filter every facet is counted with.
+func marketBaseFilter(query marketQuery) bson.M {
+	filter := activeListing()
+	if query.Text != "" {
+		filter["$text"] = bson.M{"$search": query.Text}
+	}
+	if len(query.Seller) > 0 {
+		filter["user_id"] = inFilter(query.Seller)
+	}
+	price := bson.M{}
+	if query.MinPrice > 0 {
+		price["$gte"] = query.MinPrice
+	}
+	if query.MaxPrice >= 0 {
+		price["$lte"] = query.MaxPrice
+	}
+	if len(price) > 0 {
+		filter["price"] = price
+	}
+	return filter
+}
+
+// marketFacetFilters are the filters of the facet dimensions by facet name.
+func marketFacetFilters(query marketQuery) map[string]bson.M {
+	filters := map[string]bson.M{}
+	if len(query.Club) > 0 {
+		filters["club"] = bson.M{"card_id.club": inFilter(query.Club)}
+	}
+	if len(query.Nationality) > 0 {
+		filters["nationality"] = bson.M{"card_id.nationality": inFilter(query.Nationality)}
+	}
+	if len(query.Position) > 0 {
+		filters["position"] = bson.M{"card_id.position": inFilter(query.Position)}
+	}
+	if len(query.Rarity) > 0 {
+		var rarity bson.A
+		for _, r := range query.Rarity {
+			rarity = append(rarity, r)
+			if r == "common" {
+				rarity = append(rarity, nil, "")
+			}
+		}
+		filters["rarity"] = bson.M{"card_id.rarity": bson.M{"$in": rarity}}
+	}
+	return filters
+}
+
+// facetMatch merges the facet filters but the one of except, so a facet
+// counts the values that selecting them would add to the results.
+func facetMatch(filters map[string]bson.M, except string) bson.M {
+	match := bson.M{}
+	for name, filter := range filters {
+		if name == except {
+			continue
+		}
+		for field, value := range filter {
+			match[field] = value
+		}
+	}
+	return match
+}
+func marketSearchFilter(query marketQuery) bson.M {
+	filter := marketBaseFilter(query)
+	for field, value := range facetMatch(marketFacetFilters(query), "") {
+		filter[field] = value
+	}
+	return filter
+}
+func marketSearchPipeline(query marketQuery) mongo.Pipeline {
+	fields := bson.M{
+		"card_id.rarity": bson.M{"$ifNull": bson.A{"$card_id.rarity", "common"}},
+	}
+	if query.Text != "" {
+		fields["score"] = bson.M{"$meta": "textScore"}
+	}
+	// $text must be in the first stage, the facet dimensions are matched in each branch
+	pipeline := mongo.Pipeline{
+		{{Key: "$match", Value: marketBaseFilter(query)}},
+		{{Key: "$addFields", Value: fields}},
+		{{Key: "$addFields", Value: bson.M{"rarity_rank": bson.M{"$indexOfArray": bson.A{rarities, "$card_id.rarity"}}}}},
+	}
+	filters := marketFacetFilters(query)
+	match := facetMatch(filters, "")
+	sort := bson.D{{Key: marketSortKeys[query.Sort], Value: query.Order}, {Key: "_id", Value: 1}}
+	facets := bson.M{
+		"items": bson.A{
+			bson.M{"$match": match},
+			bson.M{"$sort": sort},
+			bson.M{"$skip": (query.Page - 1) * query.PerPage},
+			bson.M{"$limit": query.PerPage},
+		},
+		"total": bson.A{
+			bson.M{"$match": match},
+			bson.M{"$count": "total"},
+		},
+	}
+	for name, field := range marketFacets {
+		facets[name] = bson.A{
+			bson.M{"$match": facetMatch(filters, name)},
+			bson.M{"$group": bson.M{"_id": field, "count": bson.M{"$sum": 1}}},
+			bson.M{"$sort": bson.D{{Key: "count", Value: -1}, {Key: "_id", Value: 1}}},
+		}
+	}
+	return append(pipeline, bson.D{{Key: "$facet", Value: facets}})
+}
+func marketSearch(w http.ResponseWriter, r *http.Request) {
+	query, err := parseMarketQuery(r.URL.Query())
+	if err != nil {
+		sendErrorMessage(w, "marketSearch", err, "Invalid query: "+err.Error()+".")
+		return
+	}
+	cursor, err := db.Collection("cards_in_deal").Aggregate(r.Context(), marketSearchPipeline(query))
+	if err != nil {
+		sendErrorMessage(w, "marketSearch", err, "Error querying the database. Try to reload page.")
+		return
+	}
+	var results []struct {
+		Items       []Deals               `bson:"items"`
+		Total       []struct{ Total int } `bson:"total"`
+		Club        []FacetCount          `bson:"club"`
+		Nationality []FacetCount          `bson:"nationality"`
+		Position    []FacetCount          `bson:"position"`
+		Rarity      []FacetCount          `bson:"rarity"`
+	}
+	if err := cursor.All(r.Context(), &results); err != nil {
+		sendErrorMessage(w, "marketSearch", err, "Error decoding database results. Try to reload page.")
+		return
+	}
+	items := []Deals{}
+	total := 0
+	facets := map[string][]FacetCount{}
+	if len(results) > 0 {
+		if results[0].Items != nil {
+			items = results[0].Items
+		}
+		if len(results[0].Total) > 0 {
+			total = results[0].Total[0].Total
+		}
+		facets["club"] = results[0].Club
+		facets["nationality"] = results[0].Nationality
+		facets["position"] = results[0].Position
+		facets["rarity"] = results[0].Rarity
+	}
+	respondWithJSON(w, http.StatusOK, map[string]interface{}{
+		"status":   "success",
+		"items":    items,
+		"total":    total,
+		"page":     query.Page,
+		"per_page": query.PerPage,
+		"facets":   facets,
+	})
+}
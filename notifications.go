@@ -0,0 +1,299 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Notifications
+type Notification struct {
+	ID      string    `bson:"_id,omitempty" json:"id"`
+	User_id string    `json:"user_id"`
+	Type    string    `json:"type"`
+	Message string    `json:"message"`
+	Link    string    `json:"link"`
+	Read    bool      `json:"read"`
+	Date    time.Time `json:"date"`
+}
+
+// Notification types
+const (
+	notifyCardReceived   = "card_received"
+	notifyItemSold       = "item_sold"
+	notifyChatReply      = "chat_reply"
+	notifyPriceAlert     = "price_alert"
+	notifyListingExpired = "listing_expired"
+	notifyChatAssigned   = "chat_assigned"
+)
+
+// notificationConn is a live notification socket, only its write goroutine writes to it.
+type notificationConn struct {
+	conn   *websocket.Conn
+	userID string
+	send   chan []byte
+}
+
+func newNotificationConn(conn *websocket.Conn, userID string) *notificationConn {
+	return &notificationConn{conn: conn, userID: userID, send: make(chan []byte, chatSendBuffer)}
+}
+
+// writeLoop writes the queued messages until the socket is removed from the hub.
+func (c *notificationConn) writeLoop() {
+	defer c.conn.Close()
+	for msg := range c.send {
+		c.conn.SetWriteDeadline(time.Now().Add(chatWriteTimeout))
+		if err := c.conn.WriteMessage(websocket.TextMessage, msg); err != nil {
+			return
+		}
+	}
+	c.conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+}
+
+// notificationHub keeps the notification sockets of every user connected to
+// this server, a user may be connected from several tabs.
+type notificationHub struct {
+	mu    sync.Mutex
+	conns map[string]map[*notificationConn]bool
+}
+
+var notificationSockets = &notificationHub{conns: map[string]map[*notificationConn]bool{}}
+
+// add registers the socket and starts its write goroutine.
+func (h *notificationHub) add(conn *notificationConn) {
+	h.mu.Lock()
+	if h.conns[conn.userID] == nil {
+		h.conns[conn.userID] = map[*notificationConn]bool{}
+	}
+	h.conns[conn.userID][conn] = true
+	h.mu.Unlock()
+	go conn.writeLoop()
+}
+
+// remove unregisters the socket and stops its write goroutine, it is safe to call twice.
+func (h *notificationHub) remove(conn *notificationConn) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.drop(conn)
+}
+
+// drop must be called with h.mu held.
+func (h *notificationHub) drop(conn *notificationConn) {
+	if !h.conns[conn.userID][conn] {
+		return
+	}
+	delete(h.conns[conn.userID], conn)
+	close(conn.send)
+	if len(h.conns[conn.userID]) == 0 {
+		delete(h.conns, conn.userID)
+	}
+}
+
+// queue must be called with h.mu held, a socket too slow to keep up is
+// dropped instead of blocking the caller.
+func (h *notificationHub) queue(conn *notificationConn, msg []byte) {
+	select {
+	case conn.send <- msg:
+	default:
+		h.drop(conn)
+	}
+}
+
+func (h *notificationHub) connections(userID string) int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return len(h.conns[userID])
+}
+
+// push queues the message to every socket of the user.
+func (h *notificationHub) push(userID string, message interface{}) {
+	msg, err := json.Marshal(message)
+	if err != nil {
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for conn := range h.conns[userID] {
+		h.queue(conn, msg)
+	}
+}
+
+// pushTo queues the message to one socket of the user.
+func (h *notificationHub) pushTo(conn *notificationConn, message interface{}) {
+	msg, err := json.Marshal(message)
+	if err != nil {
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.conns[conn.userID][conn] {
+		h.queue(conn, msg)
+	}
+}
+
+func unreadCount(ctx context.Context, userID string) (int64, error) {
+	return db.Collection("notifications").CountDocuments(ctx, bson.M{"user_id": userID, "read": false})
+}
+
+// pushUnread sends the unread count, after notifications were read in another tab.
+func pushUnread(ctx context.Context, userID string) {
+	if count, err := unreadCount(ctx, userID); err == nil {
+		notificationSockets.push(userID, map[string]interface{}{"type": "unread", "unread": count})
+	}
+}
+
+// addNotification stores a notification and pushes it to the open sockets of the user.
+func addNotification(ctx context.Context, userID string, kind string, message string, link string) error {
+	notification := Notification{
+		User_id: userID,
+		Type:    kind,
+		Message: message,
+		Link:    link,
+		Date:    time.Now(),
+	}
+	result, err := db.Collection("notifications").InsertOne(ctx, notification)
+	if err != nil {
+		return err
+	}
+	notification.ID = result.InsertedID.(primitive.ObjectID).Hex()
+	count, err := unreadCount(ctx, userID)
+	if err != nil {
+		return err
+	}
+	notificationSockets.push(userID, map[string]interface{}{
+		"type":         "notification",
+		"notification": notification,
+		"unread":       count,
+	})
+	return nil
+}
+
+// notifyUser adds a notification from a handler where failing to notify must not fail the request.
+func notifyUser(ctx context.Context, userID string, kind string, message string, link string) {
+	if err := addNotification(ctx, userID, kind, message, link); err != nil {
+		logger.WithFields(logrus.Fields{
+			"action": "notifyUser",
+			"status": "error",
+			"error":  err.Error(),
+			"type":   kind,
+		}).Error("Error adding notification")
+	}
+}
+
+// notifyAccount notifies the user of a users document id, chats are keyed by it.
+func notifyAccount(ctx context.Context, accountID string, kind string, message string, link string) {
+	objID, err := primitive.ObjectIDFromHex(accountID)
+	if err != nil {
+		return
+	}
+	var user User
+	if err := db.Collection("users").FindOne(ctx, bson.M{"_id": objID}).Decode(&user); err != nil {
+		return
+	}
+	notifyUser(ctx, user.User_id, kind, message, link)
+}
+func notifications(w http.ResponseWriter, r *http.Request) {
+	userID, err := actingUserID(r, "user_id")
+	if err != nil {
+		sendForbidden(w, "notifications", err)
+		return
+	}
+	filter := bson.M{"user_id": userID}
+	if r.URL.Query().Get("unread") == "true" {
+		filter["read"] = false
+	}
+	list := []Notification{}
+	cursor, err := db.Collection("notifications").Find(r.Context(), filter, options.Find().SetSort(bson.D{{Key: "date", Value: -1}}).SetLimit(50))
+	if err != nil {
+		sendErrorMessage(w, "notifications", err, "Error getting notifications. Try to reload page.")
+		return
+	}
+	if err := cursor.All(r.Context(), &list); err != nil {
+		sendErrorMessage(w, "notifications", err, "Error decoding notifications. Try to reload page.")
+		return
+	}
+	count, err := unreadCount(r.Context(), userID)
+	if err != nil {
+		sendErrorMessage(w, "notifications", err, "Error counting notifications. Try to reload page.")
+		return
+	}
+	respondWithJSON(w, http.StatusOK, map[string]interface{}{
+		"status":        "success",
+		"notifications": list,
+		"unread":        count,
+	})
+}
+func unreadNotifications(w http.ResponseWriter, r *http.Request) {
+	userID, err := actingUserID(r, "user_id")
+	if err != nil {
+		sendForbidden(w, "unreadNotifications", err)
+		return
+	}
+	count, err := unreadCount(r.Context(), userID)
+	if err != nil {
+		sendErrorMessage(w, "unreadNotifications", err, "Error counting notifications. Try to reload page.")
+		return
+	}
+	respondWithJSON(w, http.StatusOK, map[string]interface{}{
+		"status": "success",
+		"unread": count,
+	})
+}
+
+// readNotifications marks the notification of the id parameter read, or all of them without it.
+func readNotifications(w http.ResponseWriter, r *http.Request) {
+	userID, err := actingUserID(r, "user_id")
+	if err != nil {
+		sendForbidden(w, "readNotifications", err)
+		return
+	}
+	filter := bson.M{"user_id": userID, "read": false}
+	if id := r.URL.Query().Get("id"); id != "" {
+		objID, err := primitive.ObjectIDFromHex(id)
+		if err != nil {
+			sendErrorMessage(w, "readNotifications", err, "Invalid notification id.")
+			return
+		}
+		filter["_id"] = objID
+	}
+	if _, err := db.Collection("notifications").UpdateMany(r.Context(), filter, bson.M{"$set": bson.M{"read": true}}); err != nil {
+		sendErrorMessage(w, "readNotifications", err, "Error updating notifications. Try again.")
+		return
+	}
+	pushUnread(r.Context(), userID)
+	sendSuccessMessage(w, "readNotifications", "Notifications marked as read.", "")
+}
+
+// notificationSocket pushes the notifications of the user while the socket is open.
+func notificationSocket(w http.ResponseWriter, r *http.Request) {
+	identity, _ := identityFrom(r)
+	ws, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		logger.WithFields(logrus.Fields{
+			"action": "notificationSocket",
+			"status": "error",
+			"error":  err.Error(),
+		}).Error("Error upgrading connection")
+		return
+	}
+	conn := newNotificationConn(ws, identity.User_id)
+	notificationSockets.add(conn)
+	defer notificationSockets.remove(conn)
+	if count, err := unreadCount(r.Context(), identity.User_id); err == nil {
+		notificationSockets.pushTo(conn, map[string]interface{}{"type": "unread", "unread": count})
+	}
+	// the client does not send anything, reading notices when it goes away
+	for {
+		if _, _, err := ws.ReadMessage(); err != nil {
+			return
+		}
+	}
+}
@@ -0,0 +1,354 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Packs
+type PackType struct {
+	ID      string `bson:"_id,omitempty" json:"id"`
+	Pack_id int    `json:"pack_id"`
+	Name    string `json:"name"`
+	Price   int    `json:"price"`
+	// Credit_price is the number of subscription credits the pack costs, 0 means coins only.
+	Credit_price int `json:"credit_price"`
+	Cards        int `json:"cards"`
+	// Odds are relative weights per rarity.
+	Odds map[string]int `json:"odds"`
+	// Guarantees is the minimum number of cards of the rarity or better per pack.
+	Guarantees map[string]int `json:"guarantees"`
+}
+type PackOpening struct {
+	ID        string    `bson:"_id,omitempty" json:"id"`
+	User_id   string    `json:"user_id"`
+	Pack_id   int       `json:"pack_id"`
+	Pack_name string    `json:"pack_name"`
+	Paid_with string    `json:"paid_with"`
+	Price     int       `json:"price"`
+	Cards     []Card    `json:"cards"`
+	Date      time.Time `json:"date"`
+}
+type PackCredits struct {
+	User_id    string    `json:"user_id"`
+	Credits    int       `json:"credits"`
+	Granted_at time.Time `json:"granted_at"`
+}
+
+var errNotEnoughCredits = errors.New("not enough pack credits")
+
+// Free packs granted to premium subscribers every period.
+var subscriptionPackCredits = envInt("SUBSCRIPTION_PACK_CREDITS", 3)
+var subscriptionPeriod = time.Duration(envInt("SUBSCRIPTION_PERIOD_DAYS", 30)) * 24 * time.Hour
+
+func rarityRank(rarity string) int {
+	for i, r := range rarities {
+		if r == rarity {
+			return i
+		}
+	}
+	return -1
+}
+
+// pickRarity draws one rarity from odds restricted to rarities of rank min or better.
+func pickRarity(odds map[string]int, min int) (string, bool) {
+	total := 0
+	for _, r := range rarities {
+		if rarityRank(r) >= min && odds[r] > 0 {
+			total += odds[r]
+		}
+	}
+	if total == 0 {
+		return "", false
+	}
+	n := rand.Intn(total)
+	for _, r := range rarities {
+		if rarityRank(r) < min || odds[r] <= 0 {
+			continue
+		}
+		if n < odds[r] {
+			return r, true
+		}
+		n -= odds[r]
+	}
+	return "", false
+}
+
+// drawRarities returns the rarity of every card in a pack, guarantees are filled first.
+func drawRarities(pack PackType) ([]string, error) {
+	var drawn []string
+	for i := len(rarities) - 1; i >= 0; i-- {
+		for n := 0; n < pack.Guarantees[rarities[i]]; n++ {
+			rarity, ok := pickRarity(pack.Odds, i)
+			if !ok {
+				return nil, errors.New("pack odds can not satisfy " + rarities[i] + " guarantee")
+			}
+			drawn = append(drawn, rarity)
+		}
+	}
+	if len(drawn) > pack.Cards {
+		return nil, errors.New("pack guarantees exceed the number of cards")
+	}
+	for len(drawn) < pack.Cards {
+		rarity, ok := pickRarity(pack.Odds, 0)
+		if !ok {
+			return nil, errors.New("pack has no odds")
+		}
+		drawn = append(drawn, rarity)
+	}
+	rand.Shuffle(len(drawn), func(i, j int) { drawn[i], drawn[j] = drawn[j], drawn[i] })
+	return drawn, nil
+}
+
+// rarityFilter matches cards of the rarity, cards added before rarities existed count as common.
+func rarityFilter(rarity string) bson.M {
+	if rarity == "common" {
+		return bson.M{"rarity": bson.M{"$in": bson.A{nil, "", "common"}}}
+	}
+	return bson.M{"rarity": rarity}
+}
+func randomCardOfRarity(ctx context.Context, rarity string) (Card, error) {
+	cursor, err := db.Collection("cards").Aggregate(ctx, mongo.Pipeline{
+		{{Key: "$match", Value: rarityFilter(rarity)}},
+		{{Key: "$sample", Value: bson.M{"size": 1}}},
+		{{Key: "$project", Value: bson.M{"_id": 0}}},
+	})
+	if err != nil {
+		return Card{}, err
+	}
+	var cards []Card
+	if err := cursor.All(ctx, &cards); err != nil {
+		return Card{}, err
+	}
+	if len(cards) == 0 {
+		return Card{}, errors.New("there are no " + rarity + " cards yet")
+	}
+	return cards[0], nil
+}
+
+// refreshPackCredits tops up the credits of a premium subscriber once per period.
+// Credits are kept by user_id like wallets, transactions by the users document id.
+func refreshPackCredits(ctx context.Context, userID string) error {
+	var user User
+	if err := db.Collection("users").FindOne(ctx, bson.M{"user_id": userID}, options.FindOne().SetProjection(bson.M{"_id": 1})).Decode(&user); err != nil {
+		return err
+	}
+	since := time.Now().Add(-subscriptionPeriod)
+	err := db.Collection("transactions").FindOne(ctx, bson.M{"user_id": user.ID, "is_completed": true, "date": bson.M{"$gte": since}}).Err()
+	if err == mongo.ErrNoDocuments {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	filter := bson.M{"user_id": userID, "granted_at": bson.M{"$lt": since}}
+	update := bson.M{
+		"$inc": bson.M{"credits": subscriptionPackCredits},
+		"$set": bson.M{"granted_at": time.Now()},
+	}
+	_, err = db.Collection("pack_credits").UpdateOne(ctx, filter, update, options.Update().SetUpsert(true))
+	if mongo.IsDuplicateKeyError(err) {
+		// credits for this period were already granted
+		return nil
+	}
+	return err
+}
+func addPackType(w http.ResponseWriter, r *http.Request) {
+	var pack PackType
+	err := json.NewDecoder(r.Body).Decode(&pack)
+	if err != nil {
+		sendErrorMessage(w, "addPackType", err, "Error decoding new pack data. Try again.")
+		return
+	}
+	if pack.Name == "" || pack.Cards < 1 || pack.Price < 0 || pack.Credit_price < 0 {
+		sendErrorMessage(w, "addPackType", errors.New("invalid input"), "Pack needs a name, a positive number of cards and a non negative price.")
+		return
+	}
+	for rarity := range pack.Odds {
+		if !validRarity(rarity) {
+			sendErrorMessage(w, "addPackType", errors.New("invalid input"), "Invalid rarity "+rarity+" in odds.")
+			return
+		}
+	}
+	for rarity := range pack.Guarantees {
+		if !validRarity(rarity) {
+			sendErrorMessage(w, "addPackType", errors.New("invalid input"), "Invalid rarity "+rarity+" in guarantees.")
+			return
+		}
+	}
+	if _, err := drawRarities(pack); err != nil {
+		sendErrorMessage(w, "addPackType", err, "Invalid pack: "+err.Error()+".")
+		return
+	}
+	id, err := db.Collection("pack_types").CountDocuments(r.Context(), bson.M{})
+	if err != nil {
+		sendErrorMessage(w, "addPackType", err, "Error get size of packs collection. Try again.")
+		return
+	}
+	pack.ID = ""
+	pack.Pack_id = int(id + 1)
+	_, err = db.Collection("pack_types").InsertOne(r.Context(), pack)
+	if err != nil {
+		sendErrorMessage(w, "addPackType", err, "Error adding new pack. Try again.")
+		return
+	}
+	sendSuccessMessage(w, "addPackType", "New pack "+pack.Name+" added successfully!", "")
+}
+func packTypes(w http.ResponseWriter, r *http.Request) {
+	var packs []PackType
+	cursor, err := db.Collection("pack_types").Find(r.Context(), bson.M{}, options.Find().SetSort(bson.D{{Key: "pack_id", Value: 1}}))
+	if err != nil {
+		sendErrorMessage(w, "packTypes", err, "Error getting packs. Try to reload page.")
+		return
+	}
+	if err := cursor.All(r.Context(), &packs); err != nil {
+		sendErrorMessage(w, "packTypes", err, "Error decoding packs. Try to reload page.")
+		return
+	}
+	respondWithJSON(w, http.StatusOK, map[string]interface{}{
+		"status": "success",
+		"packs":  packs,
+	})
+}
+func packCredits(w http.ResponseWriter, r *http.Request) {
+	userID, err := actingUserID(r, "user_id")
+	if err != nil {
+		sendForbidden(w, "packCredits", err)
+		return
+	}
+	if err := refreshPackCredits(r.Context(), userID); err != nil {
+		sendErrorMessage(w, "packCredits", err, "Error refreshing pack credits. Try to reload page.")
+		return
+	}
+	credits := PackCredits{User_id: userID}
+	err = db.Collection("pack_credits").FindOne(r.Context(), bson.M{"user_id": userID}).Decode(&credits)
+	if err != nil && err != mongo.ErrNoDocuments {
+		sendErrorMessage(w, "packCredits", err, "Error getting pack credits. Try to reload page.")
+		return
+	}
+	respondWithJSON(w, http.StatusOK, map[string]interface{}{
+		"status":  "success",
+		"credits": credits,
+	})
+}
+func buyPack(w http.ResponseWriter, r *http.Request) {
+	userID, err := actingUserID(r, "user_id")
+	if err != nil {
+		sendForbidden(w, "buyPack", err)
+		return
+	}
+	packID, err := strconv.Atoi(r.URL.Query().Get("pack_id"))
+	if err != nil {
+		sendErrorMessage(w, "buyPack", err, "Invalid pack_id parameter. Try again.")
+		return
+	}
+	payWith := r.URL.Query().Get("pay")
+	if payWith == "" {
+		payWith = "coins"
+	}
+	if payWith != "coins" && payWith != "credits" {
+		sendErrorMessage(w, "buyPack", errors.New("invalid input"), "Invalid pay parameter. Pay must be coins or credits.")
+		return
+	}
+	var pack PackType
+	err = db.Collection("pack_types").FindOne(r.Context(), bson.M{"pack_id": packID}).Decode(&pack)
+	if err != nil {
+		sendErrorMessage(w, "buyPack", err, "Pack not found. Try again.")
+		return
+	}
+	if payWith == "credits" {
+		if pack.Credit_price == 0 {
+			sendErrorMessage(w, "buyPack", errors.New("invalid input"), "Pack "+pack.Name+" can not be bought with credits.")
+			return
+		}
+		if err := refreshPackCredits(r.Context(), userID); err != nil {
+			sendErrorMessage(w, "buyPack", err, "Error refreshing pack credits. Try again.")
+			return
+		}
+	}
+	drawn, err := drawRarities(pack)
+	if err != nil {
+		sendErrorMessage(w, "buyPack", err, "Error opening pack: "+err.Error()+".")
+		return
+	}
+	opening := PackOpening{
+		User_id:   userID,
+		Pack_id:   pack.Pack_id,
+		Pack_name: pack.Name,
+		Paid_with: payWith,
+	}
+	err = withTransaction(r.Context(), func(sc mongo.SessionContext) error {
+		if payWith == "credits" {
+			opening.Price = pack.Credit_price
+			result, err := db.Collection("pack_credits").UpdateOne(sc, bson.M{"user_id": userID, "credits": bson.M{"$gte": pack.Credit_price}}, bson.M{"$inc": bson.M{"credits": -pack.Credit_price}})
+			if err != nil {
+				return err
+			}
+			if result.MatchedCount == 0 {
+				return errNotEnoughCredits
+			}
+		} else {
+			opening.Price = pack.Price
+			if err := changeCoins(sc, userID, -pack.Price, "pack:"+strconv.Itoa(pack.Pack_id)); err != nil {
+				return err
+			}
+		}
+		opening.Cards = opening.Cards[:0]
+		for _, rarity := range drawn {
+			card, err := randomCardOfRarity(sc, rarity)
+			if err != nil {
+				return err
+			}
+			opening.Cards = append(opening.Cards, card)
+		}
+		_, err := db.Collection("collections").UpdateOne(sc, bson.M{"user_id": userID}, bson.M{"$push": bson.M{"card_id": bson.M{"$each": opening.Cards}}})
+		if err != nil {
+			return err
+		}
+		opening.Date = time.Now()
+		_, err = db.Collection("pack_openings").InsertOne(sc, opening)
+		return err
+	})
+	if err == errNotEnoughCoins || err == errNotEnoughCredits {
+		sendErrorMessage(w, "buyPack", err, "Not enough "+payWith+" to buy "+pack.Name+".")
+		return
+	}
+	if err != nil {
+		sendErrorMessage(w, "buyPack", err, "Error buying pack: "+err.Error()+". Try again.")
+		return
+	}
+	respondWithJSON(w, http.StatusOK, map[string]interface{}{
+		"success": "Pack " + pack.Name + " opened successfully!",
+		"opening": opening,
+	})
+}
+func packHistory(w http.ResponseWriter, r *http.Request) {
+	userID, err := actingUserID(r, "user_id")
+	if err != nil {
+		sendForbidden(w, "packHistory", err)
+		return
+	}
+	var openings []PackOpening
+	cursor, err := db.Collection("pack_openings").Find(r.Context(), bson.M{"user_id": userID}, options.Find().SetSort(bson.D{{Key: "date", Value: -1}}).SetLimit(100))
+	if err != nil {
+		sendErrorMessage(w, "packHistory", err, "Error getting pack history. Try to reload page.")
+		return
+	}
+	if err := cursor.All(r.Context(), &openings); err != nil {
+		sendErrorMessage(w, "packHistory", err, "Error decoding pack history. Try to reload page.")
+		return
+	}
+	respondWithJSON(w, http.StatusOK, map[string]interface{}{
+		"status":   "success",
+		"openings": openings,
+	})
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"html/template"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Passwords
+type PasswordReset struct {
+	ID         string    `bson:"_id,omitempty"`
+	User_id    string    `json:"user_id"`
+	Token_hash string    `json:"-"`
+	Used       bool      `json:"used"`
+	Created_at time.Time `json:"created_at"`
+	Expires_at time.Time `json:"expires_at"`
+	Last_sent  time.Time `json:"-"`
+}
+
+const minPasswordLength = 8
+
+var resetLifetime = time.Duration(envInt("RESET_TOKEN_MINUTES", 60)) * time.Minute
+var resetResendInterval = time.Duration(envInt("RESET_RESEND_SECONDS", 60)) * time.Second
+
+var errResetThrottled = errors.New("password reset email was sent recently")
+
+var errWeakPassword = errors.New("password must have at least 8 characters")
+var errWrongPassword = errors.New("wrong password")
+
+// hashPassword is the only place passwords are hashed.
+func hashPassword(password string) (string, error) {
+	if len(password) < minPasswordLength {
+		return "", errWeakPassword
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return "", err
+	}
+	return string(hash), nil
+}
+func checkPassword(hash string, password string) error {
+	if bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) != nil {
+		return errWrongPassword
+	}
+	return nil
+}
+
+// setPassword stores the new password hash and revokes the sessions of the
+// user except keepSession. Pass a mongo.SessionContext to run it inside a transaction.
+func setPassword(ctx context.Context, userID string, hash string, keepSession string) error {
+	result, err := db.Collection("users").UpdateOne(ctx, bson.M{"user_id": userID}, bson.M{"$set": bson.M{"password": hash}})
+	if err != nil {
+		return err
+	}
+	if result.MatchedCount == 0 {
+		return mongo.ErrNoDocuments
+	}
+	_, err = db.Collection("sessions").UpdateMany(ctx, bson.M{"user_id": userID, "_id": bson.M{"$ne": keepSession}}, bson.M{"$set": bson.M{"revoked": true}})
+	return err
+}
+
+// storeResetToken replaces the unused reset link of the user, at most once per
+// resetResendInterval. A user has one unused link, so only the newest link works.
+func storeResetToken(ctx context.Context, userID string) (string, error) {
+	token := newTokenID()
+	now := time.Now()
+	filter := bson.M{
+		"user_id": userID,
+		"used":    false,
+		"$or": bson.A{
+			bson.M{"last_sent": bson.M{"$lte": now.Add(-resetResendInterval)}},
+			bson.M{"last_sent": bson.M{"$exists": false}},
+		},
+	}
+	update := bson.M{"$set": bson.M{
+		"token_hash": hashSecret(token),
+		"created_at": now,
+		"expires_at": now.Add(resetLifetime),
+		"last_sent":  now,
+	}}
+	_, err := db.Collection("password_resets").UpdateOne(ctx, filter, update, options.Update().SetUpsert(true))
+	if mongo.IsDuplicateKeyError(err) {
+		return "", errResetThrottled
+	}
+	if err != nil {
+		return "", err
+	}
+	return token, nil
+}
+func forgotPassword(w http.ResponseWriter, r *http.Request) {
+	email := r.URL.Query().Get("email")
+	// the answer does not tell whether the email is registered
+	message := "If the email is registered, a link to reset the password was sent."
+	var user User
+	err := db.Collection("users").FindOne(r.Context(), bson.M{"email": email}).Decode(&user)
+	if err == mongo.ErrNoDocuments {
+		sendSuccessMessage(w, "forgotPassword", message, "")
+		return
+	}
+	if err != nil {
+		sendErrorMessage(w, "forgotPassword", err, "Error resetting password. Try again.")
+		return
+	}
+	token, err := storeResetToken(r.Context(), user.User_id)
+	if err == errResetThrottled {
+		// no new email, the address must not be flooded
+		sendSuccessMessage(w, "forgotPassword", message, "")
+		return
+	}
+	if err != nil {
+		sendErrorMessage(w, "forgotPassword", err, "Error resetting password. Try again.")
+		return
+	}
+	data := map[string]interface{}{
+		"Link":    appURL() + "/resetPage?token=" + url.QueryEscape(token),
+		"Minutes": int(resetLifetime.Minutes()),
+	}
+	if err := sendTemplate(r.Context(), user.Email, userLanguage(user), "password_reset", data); err != nil {
+		sendErrorMessage(w, "forgotPassword", err, "Error send message. Try again.")
+		return
+	}
+	sendSuccessMessage(w, "forgotPassword", message, "")
+}
+func resetPage(w http.ResponseWriter, r *http.Request) {
+	tmpl, err := template.ParseFiles("reset.html")
+	if err != nil {
+		logger.WithFields(logrus.Fields{
+			"action": "resetPage",
+			"status": "error",
+			"error":  err.Error(),
+		}).Error("Error parsing template file 'reset.html'")
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	tmpl.ExecuteTemplate(w, "reset.html", r.URL.Query().Get("token"))
+}
+func resetPassword(w http.ResponseWriter, r *http.Request) {
+	var data struct {
+		Token    string `json:"token"`
+		Password string `json:"password"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
+		sendErrorMessage(w, "resetPassword", err, "Error decoding password data. Try again.")
+		return
+	}
+	hash, err := hashPassword(data.Password)
+	if err != nil {
+		sendErrorMessage(w, "resetPassword", err, "Invalid password: "+err.Error()+".")
+		return
+	}
+	err = withTransaction(r.Context(), func(sc mongo.SessionContext) error {
+		var reset PasswordReset
+		filter := bson.M{"token_hash": hashSecret(data.Token), "used": false, "expires_at": bson.M{"$gt": time.Now()}}
+		err := db.Collection("password_resets").FindOneAndUpdate(sc, filter, bson.M{"$set": bson.M{"used": true}}).Decode(&reset)
+		if err != nil {
+			return err
+		}
+		return setPassword(sc, reset.User_id, hash, "")
+	})
+	if err == mongo.ErrNoDocuments {
+		sendErrorMessage(w, "resetPassword", err, "The reset link is invalid or expired. Request a new one.")
+		return
+	}
+	if err != nil {
+		sendErrorMessage(w, "resetPassword", err, "Error resetting password. Try again.")
+		return
+	}
+	sendSuccessMessage(w, "resetPassword", "Password changed. Log in with the new password.", "")
+}
+func changePassword(w http.ResponseWriter, r *http.Request) {
+	identity, _ := identityFrom(r)
+	var data struct {
+		Current_password string `json:"current_password"`
+		New_password     string `json:"new_password"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
+		sendErrorMessage(w, "changePassword", err, "Error decoding password data. Try again.")
+		return
+	}
+	var user User
+	err := db.Collection("users").FindOne(r.Context(), bson.M{"user_id": identity.User_id}).Decode(&user)
+	if err != nil {
+		sendErrorMessage(w, "changePassword", err, "User not found.")
+		return
+	}
+	if err := checkPassword(user.Password, data.Current_password); err != nil {
+		sendErrorMessage(w, "changePassword", err, "Incorrect current password. Try again.")
+		return
+	}
+	hash, err := hashPassword(data.New_password)
+	if err != nil {
+		sendErrorMessage(w, "changePassword", err, "Invalid password: "+err.Error()+".")
+		return
+	}
+	err = withTransaction(r.Context(), func(sc mongo.SessionContext) error {
+		return setPassword(sc, user.User_id, hash, identity.Session_id)
+	})
+	if err != nil {
+		sendErrorMessage(w, "changePassword", err, "Error changing password. Try again.")
+		return
+	}
+	sendSuccessMessage(w, "changePassword", "Password changed. Other devices were logged out.", "")
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/gorilla/mux"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/time/rate"
+)
+
+// Rate limiting
+type rateRule struct {
+	Rate  rate.Limit
+	Burst int
+}
+type rateBucket struct {
+	limiter  *rate.Limiter
+	lastSeen time.Time
+}
+
+// rateLimiter keeps a token bucket per route and client.
+type rateLimiter struct {
+	mu      sync.Mutex
+	buckets map[string]*rateBucket
+}
+
+var defaultRateRule = rateRule{Rate: 5, Burst: 20}
+
+// routeRateRules overrides the default per route path template.
+var routeRateRules = map[string]rateRule{
+	"/login":       {Rate: rate.Every(12 * time.Second), Burst: 5},
+	"/loginVerify": {Rate: rate.Every(12 * time.Second), Burst: 5},
+	"/createUser":  {Rate: rate.Every(time.Minute), Burst: 3},
+	"/giveCard":    {Rate: rate.Every(6 * time.Second), Burst: 5},
+	"/marketCards": {Rate: 10, Burst: 30},
+}
+
+var rateIdleTimeout = time.Duration(envInt("RATE_LIMIT_IDLE_MINUTES", 10)) * time.Minute
+var requestLimiter = newRateLimiter()
+
+func newRateLimiter() *rateLimiter {
+	return &rateLimiter{buckets: map[string]*rateBucket{}}
+}
+
+// reserve takes a token from the bucket of every key and returns how long to
+// wait before retrying when one of them has none, then no token is taken.
+func (l *rateLimiter) reserve(keys []string, rule rateRule, now time.Time) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	var wait time.Duration
+	reservations := make([]*rate.Reservation, 0, len(keys))
+	for _, key := range keys {
+		bucket, ok := l.buckets[key]
+		if !ok {
+			bucket = &rateBucket{limiter: rate.NewLimiter(rule.Rate, rule.Burst)}
+			l.buckets[key] = bucket
+		}
+		bucket.lastSeen = now
+		reservation := bucket.limiter.ReserveN(now, 1)
+		reservations = append(reservations, reservation)
+		if delay := reservation.DelayFrom(now); delay > wait {
+			wait = delay
+		}
+	}
+	if wait > 0 {
+		for _, reservation := range reservations {
+			reservation.CancelAt(now)
+		}
+	}
+	return wait
+}
+
+// evict drops the buckets not used since before, they are full again anyway.
+func (l *rateLimiter) evict(before time.Time) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for key, bucket := range l.buckets {
+		if bucket.lastSeen.Before(before) {
+			delete(l.buckets, key)
+		}
+	}
+}
+func evictIdleBuckets() {
+	for range time.Tick(time.Minute) {
+		requestLimiter.evict(time.Now().Add(-rateIdleTimeout))
+	}
+}
+
+// rateClients identifies the client by ip and, with a valid token, also by
+// user, so neither rotating addresses nor sharing one gets around the limits.
+func rateClients(r *http.Request) []string {
+	clients := []string{"ip:" + clientIP(r)}
+	if tokenString, ok := requestToken(r); ok {
+		if token, err := verifyToken(tokenString); err == nil && token.Valid {
+			if claims, ok := token.Claims.(jwt.MapClaims); ok {
+				if userID := identityFromClaims(claims).User_id; userID != "" {
+					clients = append(clients, "user:"+userID)
+				}
+			}
+		}
+	}
+	return clients
+}
+
+// rateLimit is the router middleware applying the limits of the matched route.
+func rateLimit(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path := r.URL.Path
+		if route := mux.CurrentRoute(r); route != nil {
+			if template, err := route.GetPathTemplate(); err == nil {
+				path = template
+			}
+		}
+		rule, ok := routeRateRules[path]
+		if !ok {
+			rule = defaultRateRule
+		}
+		clients := rateClients(r)
+		keys := make([]string, len(clients))
+		for i, client := range clients {
+			keys[i] = path + " " + client
+		}
+		if delay := requestLimiter.reserve(keys, rule, time.Now()); delay > 0 {
+			logger.WithFields(logrus.Fields{
+				"action": "rateLimit",
+				"status": "error",
+				"path":   path,
+				"client": strings.Join(clients, ","),
+			}).Warn("Too many requests.")
+			w.Header().Set("Retry-After", strconv.Itoa(waitSeconds(delay)))
+			http.Error(w, "Too Many Requests", http.StatusTooManyRequests)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// Roles
+const (
+	roleUser          = "user"
+	roleSupport       = "support"
+	roleContentEditor = "content-editor"
+	roleAdmin         = "admin"
+)
+
+var roles = []string{roleUser, roleSupport, roleContentEditor, roleAdmin}
+
+// Permissions checked by requirePermission
+const (
+	permAdminPage = "admin-page"
+	permContent   = "content"
+	permSupport   = "support"
+	permUsers     = "users"
+	permEconomy   = "economy"
+)
+
+// rolePermissions lists what every role is allowed to do, admin can do everything.
+var rolePermissions = map[string][]string{
+	roleSupport:       {permAdminPage, permSupport},
+	roleContentEditor: {permAdminPage, permContent},
+	roleAdmin:         {permAdminPage, permContent, permSupport, permUsers, permEconomy},
+}
+
+var errLastAdmin = errors.New("can not revoke the role of the last admin")
+
+func validRole(role string) bool {
+	for _, r := range roles {
+		if r == role {
+			return true
+		}
+	}
+	return false
+}
+
+// userRoles returns the roles of the user, users created before roles existed are plain users.
+func userRoles(user User) []string {
+	if len(user.Roles) == 0 {
+		return []string{roleUser}
+	}
+	return user.Roles
+}
+func hasRole(userRoles []string, role string) bool {
+	for _, r := range userRoles {
+		if r == role {
+			return true
+		}
+	}
+	return false
+}
+func hasPermission(userRoles []string, permission string) bool {
+	for _, role := range userRoles {
+		for _, p := range rolePermissions[role] {
+			if p == permission {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// claimRoles reads the roles claim of a token.
+func claimRoles(claims jwt.MapClaims) []string {
+	list, _ := claims["roles"].([]interface{})
+	var result []string
+	for _, role := range list {
+		if name, ok := role.(string); ok {
+			result = append(result, name)
+		}
+	}
+	return result
+}
+
+// requirePermission lets the request through only when the authenticated
+// user has a role with the given permission.
+func requirePermission(permission string, next http.Handler) http.Handler {
+	return authenticate(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		identity, _ := identityFrom(r)
+		if !hasPermission(identity.Roles, permission) {
+			logger.WithFields(logrus.Fields{
+				"action":     "requirePermission",
+				"status":     "error",
+				"permission": permission,
+				"path":       r.URL.Path,
+			}).Error("Access denied.")
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		if !identity.MFA {
+			policy, err := twoFactorPolicy(r.Context())
+			if err != nil || policy.blocks(identity.Roles, identity.MFA, time.Now()) {
+				logger.WithFields(logrus.Fields{
+					"action":     "requirePermission",
+					"status":     "error",
+					"permission": permission,
+					"path":       r.URL.Path,
+				}).Error("Two-factor authentication required.")
+				if err == nil {
+					err = errTwoFactorRequired
+				}
+				sendForbidden(w, "requirePermission", err)
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	}))
+}
+
+// ensureAdmin grants the admin role to ADMIN_EMAIL (admin@gmail.com by
+// default) while nobody has it, so an existing install keeps its admin.
+func ensureAdmin(ctx context.Context) {
+	count, err := db.Collection("users").CountDocuments(ctx, bson.M{"roles": roleAdmin})
+	if err != nil || count > 0 {
+		return
+	}
+	email := os.Getenv("ADMIN_EMAIL")
+	if email == "" {
+		email = "admin@gmail.com"
+	}
+	_, err = db.Collection("users").UpdateOne(ctx, bson.M{"email": email}, bson.M{"$addToSet": bson.M{"roles": bson.M{"$each": bson.A{roleUser, roleAdmin}}}})
+	if err != nil {
+		logger.WithFields(logrus.Fields{
+			"action": "ensureAdmin",
+			"status": "error",
+			"error":  err.Error(),
+		}).Error("Error granting admin role")
+	}
+}
+func getUserRoles(w http.ResponseWriter, r *http.Request) {
+	var user User
+	err := db.Collection("users").FindOne(r.Context(), bson.M{"user_id": r.URL.Query().Get("id")}).Decode(&user)
+	if err != nil {
+		sendErrorMessage(w, "getUserRoles", err, "User not found.")
+		return
+	}
+	respondWithJSON(w, http.StatusOK, map[string]interface{}{
+		"status": "success",
+		"roles":  userRoles(user),
+	})
+}
+func grantRole(w http.ResponseWriter, r *http.Request) {
+	userID := r.URL.Query().Get("id")
+	role := r.URL.Query().Get("role")
+	if !validRole(role) {
+		sendErrorMessage(w, "grantRole", errors.New("invalid input"), "Invalid role "+role+".")
+		return
+	}
+	result, err := db.Collection("users").UpdateOne(r.Context(), bson.M{"user_id": userID}, bson.M{"$addToSet": bson.M{"roles": bson.M{"$each": bson.A{roleUser, role}}}})
+	if err != nil {
+		sendErrorMessage(w, "grantRole", err, "Error granting role. Try again.")
+		return
+	}
+	if result.MatchedCount == 0 {
+		sendErrorMessage(w, "grantRole", mongo.ErrNoDocuments, "User not found.")
+		return
+	}
+	sendSuccessMessage(w, "grantRole", "Role "+role+" granted. It applies from the next login.", "")
+}
+func revokeRole(w http.ResponseWriter, r *http.Request) {
+	userID := r.URL.Query().Get("id")
+	role := r.URL.Query().Get("role")
+	if !validRole(role) || role == roleUser {
+		sendErrorMessage(w, "revokeRole", errors.New("invalid input"), "Invalid role "+role+".")
+		return
+	}
+	var result *mongo.UpdateResult
+	err := withTransaction(r.Context(), func(sc mongo.SessionContext) error {
+		var err error
+		result, err = db.Collection("users").UpdateOne(sc, bson.M{"user_id": userID}, bson.M{"$pull": bson.M{"roles": role}})
+		if err != nil || role != roleAdmin {
+			return err
+		}
+		count, err := db.Collection("users").CountDocuments(sc, bson.M{"roles": roleAdmin})
+		if err != nil {
+			return err
+		}
+		if count == 0 {
+			return errLastAdmin
+		}
+		return nil
+	})
+	if err == errLastAdmin {
+		sendErrorMessage(w, "revokeRole", err, "Can not revoke the role: "+err.Error()+".")
+		return
+	}
+	if err != nil {
+		sendErrorMessage(w, "revokeRole", err, "Error revoking role. Try again.")
+		return
+	}
+	if result.MatchedCount == 0 {
+		sendErrorMessage(w, "revokeRole", mongo.ErrNoDocuments, "User not found.")
+		return
+	}
+	sendSuccessMessage(w, "revokeRole", "Role "+role+" revoked. It applies from the next login.", "")
+}
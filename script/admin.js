@@ -88,11 +88,13 @@ function addCards(event) {
 	var nationality = document.getElementById('nationality').value;
 	var club = document.getElementById('club').value;
 	var position = document.getElementById('position').value;
+	var rarity = document.getElementById('rarity').value;
 	var formData = {
 			Name: name,
 			Nationality: nationality,
 			Club: club,
-			Position: position
+			Position: position,
+			Rarity: rarity
 	};
 	fetch('/addCard', {
 		method: 'POST',
@@ -171,14 +173,70 @@ function showChats(tabId) {
 								alert('Please select a chat before pressing the button.');
 								return;
 						}
-						openChatModal(selectedChatId.value);
+						if (tabId === 'allChats') {
+							claimChat(selectedChatId.value);
+						} else {
+							openChatModal(selectedChatId.value);
+						}
 					});
 					container.appendChild(sendBtn);
+					if (tabId === 'allChats') {
+						const nextBtn = document.createElement('button');
+						nextBtn.textContent = 'Take Next Chat';
+						nextBtn.addEventListener('click', () => claimChat(''));
+						container.appendChild(nextBtn);
+					} else {
+						const releaseBtn = document.createElement('button');
+						releaseBtn.textContent = 'Release Selected Chat';
+						releaseBtn.addEventListener('click', () => {
+							const selectedChatId = document.querySelector('input[name="chatId"]:checked');
+							if (selectedChatId) {
+								queueAction(`/supportQueue/release?chat_id=${selectedChatId.value}`, tabId);
+							}
+						});
+						container.appendChild(releaseBtn);
+						const transferBtn = document.createElement('button');
+						transferBtn.textContent = 'Transfer Selected Chat';
+						transferBtn.addEventListener('click', () => {
+							const selectedChatId = document.querySelector('input[name="chatId"]:checked');
+							const to = selectedChatId && prompt('ID of the agent to transfer the chat to:');
+							if (to) {
+								queueAction(`/supportQueue/transfer?chat_id=${selectedChatId.value}&to=${encodeURIComponent(to)}`, tabId);
+							}
+						});
+						container.appendChild(transferBtn);
+					}
 				}
 		}).catch(error => {
 				console.error('Error fetching chats:', error);
 		});
 }
+// claimChat takes the chat from the queue, or the chat waiting longest without an id, and opens it.
+function claimChat(chatId) {
+	fetch(`/supportQueue/claim?chat_id=${chatId}`, {
+		method: 'POST'
+	}).then(response => response.json())
+	.then(data => {
+		if (data.error) {
+			alert(data.error);
+		} else {
+			openChatModal(data.chat.ID);
+		}
+	}).catch(error => {
+			console.error('Error claiming chat:', error);
+	});
+}
+function queueAction(url, tabId) {
+	fetch(url, {
+		method: 'POST'
+	}).then(response => response.json())
+	.then(data => {
+		alert(data.error || data.success);
+		showChats(tabId);
+	}).catch(error => {
+			console.error('Error updating chat:', error);
+	});
+}
 function openChatModal(chatId) {
 	var adminWs
 	try {
@@ -191,7 +249,7 @@ function openChatModal(chatId) {
 	const modalMessagesDiv = document.getElementById('modalMessages');
 	modalMessagesDiv.innerHTML = `<p>Chat ID: ${chatId}</p>`;
 	modal.style.display = "block";
-	fetch(`/getChat?id=${getValue("user-data")}&role=admin`)
+	fetch(`/getChat?id=${getValue("user-data")}&role=admin&chat_id=${chatId}`)
 	.then(response => {
 		if (response.ok) {
 				return response.json();
@@ -18,6 +18,20 @@ function fetchPlayersData() {
 			console.error('There was a problem with the fetch operation:', error);
 	});
 }
+// claim set reward
+function claimSet(setId) {
+	fetch(`/claimSet?user_id=${userId}&set_id=${setId}`, {
+		method: 'POST'
+	})
+	.then(response => response.json())
+	.then(data => {
+			if(data.error) { alert(data.error); }
+			else if (data.success){ alert(data.success); location.reload(); }
+	})
+	.catch(error => {
+			console.error('There was a problem with the fetch operation:', error);
+	});
+}
 // Save team button click event
 document.getElementById('saveTeamButton').addEventListener('click', () => {
 		const dropZones = document.querySelectorAll('.drop-zone');
@@ -17,17 +17,27 @@ function sendCardData(cardId,userId) {
 }
 // display cards
 let currentPage = 1
+let nextCursor = ''
+let prevCursor = ''
 var page = document.getElementById("currentPage")
 let filter = document.getElementById('positionFilter').value
 let sortBy = document.getElementById('sortCards').value
-document.getElementById('prevPage').disabled = currentPage === 1;
-document.addEventListener('DOMContentLoaded', fetchData);
-function fetchData() {
-		fetch(`/marketCards?page=${currentPage}&filter=${encodeURIComponent(filter)}&sort=${encodeURIComponent(`card_id.${sortBy}`)}`)
+document.addEventListener('DOMContentLoaded', () => fetchData(''));
+function fetchData(cursor) {
+		fetch(`/marketCards?cursor=${encodeURIComponent(cursor)}&filter=${encodeURIComponent(filter)}&sort=${encodeURIComponent(`card_id.${sortBy}`)}`)
 				.then(response => response.json())
 				.then(data => {
 						if(data.error) { alert(data.error); }
-						else { displayData(data); }
+						else {
+							var myDiv = document.getElementById('marketCards');
+							myDiv.innerHTML = '';
+							nextCursor = data.next;
+							prevCursor = data.prev;
+							page.innerHTML = currentPage;
+							document.getElementById('nextPage').disabled = !nextCursor;
+							document.getElementById('prevPage').disabled = !prevCursor;
+							displayData(data);
+						}
 				})
 				.catch(error => {
 						console.error('There was a problem with the fetch operation:', error);
@@ -36,7 +46,7 @@ function fetchData() {
 function displayData(data) {
 		const dataContainer = document.getElementById('marketCards');
 		
-		data.forEach(item => {
+		data.items.forEach(item => {
 
 					const user_id = document.createElement('p');
 					user_id.textContent = `User_id: ${item["user_id"]}`;
@@ -58,6 +68,9 @@ function displayData(data) {
 
 					const position = document.createElement('p');
 					position.textContent = `Position: ${item["card_id"]["position"]}`;
+
+					const price = document.createElement('p');
+					price.textContent = `Price: ${item["price"]}`;
 					
 					div.appendChild(user_id);
 					div.appendChild(card_id);
@@ -65,6 +78,7 @@ function displayData(data) {
 					div.appendChild(club);
 					div.appendChild(nationality);
 					div.appendChild(position);
+					div.appendChild(price);
 					dataContainer.appendChild(div);
 		});
 }
@@ -74,24 +88,7 @@ document.getElementById("filterForm").addEventListener("submit", function(event)
 	filter = document.getElementById('positionFilter').value;
 	if (filter) {
 		currentPage = 1
-		page.innerHTML = currentPage;
-		document.getElementById('nextPage').disabled = false;
-		document.getElementById('prevPage').disabled = currentPage === 1;
-		fetch(`/marketCards?page=${currentPage}&filter=${encodeURIComponent(filter)}&sort=${encodeURIComponent(`card_id.${sortBy}`)}`, {
-				method: 'GET',
-		})
-		.then(response => response.json())
-		.then(data => {
-				if(data.error) { alert(data.error); }
-				else { 
-					var myDiv = document.getElementById('marketCards');
-					myDiv.innerHTML = '';
-					displayData(data); 
-				}
-		})
-		.catch(error => {
-				console.error('There was a problem with the fetch operation:', error);
-		});
+		fetchData('');
 	} else {
 				alert('Please select a position before submitting.');
 		}
@@ -103,24 +100,7 @@ document.getElementById("sortForm").addEventListener("submit", function(event){
 	filter = document.getElementById('positionFilter').value;
 	if (sortBy) {
 		currentPage = 1
-		page.innerHTML = currentPage;
-		document.getElementById('nextPage').disabled = false;
-		document.getElementById('prevPage').disabled = currentPage === 1;
-		fetch(`/marketCards?page=${currentPage}&filter=${encodeURIComponent(filter)}&sort=${encodeURIComponent(`card_id.${sortBy}`)}`, {
-				method: 'GET',
-		})
-		.then(response => response.json())
-		.then(data => {
-				if(data.error) { alert(data.error); }
-				else { 
-					var myDiv = document.getElementById('marketCards');
-					myDiv.innerHTML = '';
-					displayData(data); 
-				}
-		})
-		.catch(error => {
-				console.error('There was a problem with the fetch operation:', error);
-		});
+		fetchData('');
 	} else {
 				alert('Please select a position before submitting.');
 		}
@@ -128,55 +108,9 @@ document.getElementById("sortForm").addEventListener("submit", function(event){
 // pagination
 document.getElementById("nextPage").addEventListener("click", function(){
 	currentPage += 1
-	page.innerHTML = currentPage;
-	fetch(`/marketCards?page=${currentPage}&filter=${encodeURIComponent(filter)}&sort=${encodeURIComponent(`card_id.${sortBy}`)}`, {
-		method: 'GET',
-	})
-		.then(response => response.json())
-		.then(data => {
-				if(data.error) { alert(data.error); }
-				else { 
-					var myDiv = document.getElementById('marketCards');
-					myDiv.innerHTML = '';
-					displayData(data); 
-				}
-		})
-		.catch(error => {
-				console.error('There was a problem with the fetch operation:', error);
-		});
-	document.getElementById('prevPage').disabled = currentPage === 1;
-	if (currentPage != 1) {
-		document.getElementById('prevPage').disabled = false;
-	}
-	document.getElementById('nextPage').disabled = currentPage === 8;
-	if (currentPage != 8) {
-		document.getElementById('nextPage').disabled = false;
-	}
+	fetchData(nextCursor);
 })
 document.getElementById("prevPage").addEventListener("click", function(){
 	currentPage -= 1;
-	page.innerHTML = currentPage;
-	fetch(`/marketCards?page=${currentPage}&filter=${encodeURIComponent(filter)}&sort=${encodeURIComponent(`card_id.${sortBy}`)}`, {
-		method: 'GET',
-	})
-		.then(response => response.json())
-		.then(data => {
-				if(data.error) { alert(data.error); }
-				else { 
-					var myDiv = document.getElementById('marketCards');
-					myDiv.innerHTML = '';
-					displayData(data); 
-				}
-		})
-		.catch(error => {
-				console.error('There was a problem with the fetch operation:', error);
-		});
-	document.getElementById('prevPage').disabled = currentPage === 1;
-	if (currentPage != 1) {
-		document.getElementById('prevPage').disabled = false;
-	}
-	document.getElementById('nextPage').disabled = currentPage === 8;
-	if (currentPage != 8) {
-		document.getElementById('nextPage').disabled = false;
-	}
-})
\ No newline at end of file
+	fetchData(prevCursor);
+})
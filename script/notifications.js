@@ -0,0 +1,50 @@
+// Live notifications: keeps the unread badge up to date and shows new notifications.
+function connectNotifications() {
+	const badge = document.getElementById("notification-count");
+	const protocol = window.location.protocol === "https:" ? "wss" : "ws";
+	const socket = new WebSocket(`${protocol}://${window.location.host}/notifications/ws`);
+	socket.onmessage = function(event) {
+		const data = JSON.parse(event.data);
+		badge.textContent = data.unread > 0 ? data.unread : "";
+		if (data.type === "notification") {
+			showNotification(data.notification);
+		}
+	};
+	socket.onclose = function() {
+		setTimeout(connectNotifications, 5000);
+	};
+}
+function showNotification(notification) {
+	const list = document.getElementById("notification-list");
+	const item = document.createElement("li");
+	item.textContent = notification.message;
+	item.onclick = function() {
+		fetch(`/notifications/read?id=${notification.id}`, { method: 'POST' })
+		.then(() => {
+			if (notification.link) {
+				window.location.href = notification.link;
+			}
+		});
+	};
+	list.prepend(item);
+}
+function loadNotifications() {
+	fetch('/notifications?unread=true')
+	.then(response => response.json())
+	.then(data => {
+			if (data.error) {
+				return;
+			}
+			data.notifications.reverse().forEach(showNotification);
+	}).catch(error => {
+			console.error('There was a problem with the fetch operation:', error);
+	});
+}
+function readAllNotifications() {
+	fetch('/notifications/read', { method: 'POST' })
+	.then(() => {
+			document.getElementById("notification-list").innerHTML = "";
+	});
+}
+loadNotifications();
+connectNotifications();
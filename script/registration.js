@@ -38,14 +38,115 @@ function loginUser(event) {
 			if(data.error) {
 				alert(data.error);
 			}
+			else if (data.success == "TwoFactor") {
+				verifyLogin(data.token);
+			}
 			else if (data.success){
-				if (data.success == "Admin") {
-					window.location.href = `/admin?token=${data.token}`;
-				}
-				else {
-					window.location.href = `/homePage?token=${data.token}`;
-				}
+				openStartPage(data);
+			}
+	}).catch(error => {
+			console.error('There was a problem with the fetch operation:', error);
+	});
+}
+function openStartPage(data) {
+	fetch('/twoFactor')
+	.then(response => response.json())
+	.then(status => {
+			if (status.required && !status.enabled) {
+				enrollTwoFactor(data, status);
+			}
+			else {
+				redirectStartPage(data);
+			}
+	}).catch(error => {
+			console.error('There was a problem with the fetch operation:', error);
+			redirectStartPage(data);
+	});
+}
+function redirectStartPage(data) {
+	if (data.success == "Admin") {
+		window.location.href = `/admin?token=${data.token}`;
+	}
+	else {
+		window.location.href = `/homePage?token=${data.token}`;
+	}
+}
+function enrollTwoFactor(data, status) {
+	const deadline = new Date(status.grace_until);
+	const late = deadline <= new Date();
+	const message = late ? "Your role requires two-factor authentication. Enable it to continue?" : `Your role requires two-factor authentication from ${deadline.toLocaleDateString()}. Enable it now?`;
+	if (!confirm(message)) {
+		if (!late) {
+			redirectStartPage(data);
+		}
+		return;
+	}
+	fetch('/twoFactor/enroll', {
+			method: 'POST'
+	}).then(response => response.json())
+	.then(enrolment => {
+			if (enrolment.error) {
+				throw new Error(enrolment.error);
+			}
+			const code = prompt(`Add this key to your authenticator app, then enter the code it shows:\n${enrolment.secret}\n\n${enrolment.uri}`);
+			if (!code) {
+				throw new Error("Two-factor authentication was not enabled.");
+			}
+			return fetch('/twoFactor/confirm', {
+					method: 'POST',
+					headers: { 'Content-Type': 'application/json' },
+					body: JSON.stringify({ code: code })
+			});
+	}).then(response => response.json())
+	.then(confirmation => {
+			if (confirmation.error) {
+				throw new Error(confirmation.error);
 			}
+			alert(`Two-factor authentication enabled. Keep these recovery codes:\n${confirmation.recovery_codes.join("\n")}`);
+			// the session passed two-factor authentication, its new token says so
+			return fetch('/refreshToken', { method: 'POST' });
+	}).then(response => response.json())
+	.then(refreshed => {
+			if (refreshed.error) {
+				throw new Error(refreshed.error);
+			}
+			redirectStartPage({ success: data.success, token: refreshed.token });
+	}).catch(error => {
+			alert(error.message);
+	});
+}
+function verifyLogin(challenge) {
+	const code = prompt("Enter the code from your authenticator app or a recovery code:");
+	if (!code) {
+		return;
+	}
+	fetch('/loginVerify', {
+			method: 'POST',
+			headers: { 'Content-Type': 'application/json' },
+			body: JSON.stringify({ challenge: challenge, code: code })
+	}).then(response => response.json())
+	.then(data => {
+			if(data.error) {
+				alert(data.error);
+			}
+			else if (data.success){
+				openStartPage(data);
+			}
+	}).catch(error => {
+			console.error('There was a problem with the fetch operation:', error);
+	});
+}
+function forgotPassword() {
+	const email = document.getElementById("login2").value
+	if (!email) {
+		alert("Enter your email first.");
+		return;
+	}
+	fetch(`/forgotPassword?email=${encodeURIComponent(email)}`, {
+			method: 'POST'
+	}).then(response => response.json())
+	.then(data => {
+			alert(data.error || data.success);
 	}).catch(error => {
 			console.error('There was a problem with the fetch operation:', error);
 	});
@@ -0,0 +1,260 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Sessions
+type Session struct {
+	ID           string    `bson:"_id" json:"id"`
+	User_id      string    `json:"user_id"`
+	Refresh_hash string    `json:"-"`
+	Device       string    `json:"device"`
+	IP           string    `json:"ip"`
+	Created_at   time.Time `json:"created_at"`
+	Last_used    time.Time `json:"last_used"`
+	Expires_at   time.Time `json:"expires_at"`
+	Revoked      bool      `json:"revoked"`
+	// Previous_hash is the refresh token replaced at Rotated_at, see refreshGrace.
+	Previous_hash string    `json:"-"`
+	Rotated_at    time.Time `json:"-"`
+	// Mfa is set when the session was started with the second factor.
+	Mfa     bool `json:"mfa"`
+	Current bool `bson:"-" json:"current"`
+}
+
+var refreshLifetime = time.Duration(envInt("REFRESH_TOKEN_DAYS", 30)) * 24 * time.Hour
+
+// refreshGrace is how long the replaced refresh token is still accepted. Pages
+// send several requests at once when the access token expires and all but the
+// first carry the refresh token the first one just rotated.
+var refreshGrace = time.Duration(envInt("REFRESH_REUSE_GRACE_SECONDS", 30)) * time.Second
+
+var errInvalidRefreshToken = errors.New("invalid refresh token")
+
+// A refresh token is "<session id>.<secret>", only the hash of the secret is stored.
+func newRefreshToken(sessionID string) (string, string) {
+	secret := newTokenID()
+	return sessionID + "." + secret, hashSecret(secret)
+}
+func splitRefreshToken(token string) (string, string, bool) {
+	sessionID, secret, ok := strings.Cut(token, ".")
+	if !ok || sessionID == "" || secret == "" {
+		return "", "", false
+	}
+	return sessionID, secret, true
+}
+
+func setSessionCookies(w http.ResponseWriter, access string, refresh string) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     "auth-token",
+		Value:    access,
+		HttpOnly: true,
+		Path:     "/",
+	})
+	// a refresh within the grace window keeps the refresh cookie set by the first one
+	if refresh == "" {
+		return
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     "refresh-token",
+		Value:    refresh,
+		HttpOnly: true,
+		Path:     "/",
+		Expires:  time.Now().Add(refreshLifetime),
+	})
+}
+func clearSessionCookies(w http.ResponseWriter) {
+	for _, name := range []string{"auth-token", "refresh-token"} {
+		http.SetCookie(w, &http.Cookie{Name: name, Value: "", Path: "/", MaxAge: -1})
+	}
+}
+
+// startSession stores a new session of the user and returns its access and refresh tokens.
+func startSession(ctx context.Context, r *http.Request, user *User, mfa bool) (string, string, error) {
+	now := time.Now()
+	session := Session{
+		ID:         newTokenID(),
+		User_id:    user.User_id,
+		Device:     r.UserAgent(),
+		IP:         clientIP(r),
+		Created_at: now,
+		Last_used:  now,
+		Expires_at: now.Add(refreshLifetime),
+		Mfa:        mfa,
+	}
+	refresh, hash := newRefreshToken(session.ID)
+	session.Refresh_hash = hash
+	if _, err := db.Collection("sessions").InsertOne(ctx, session); err != nil {
+		return "", "", err
+	}
+	access, err := generateToken(user, &session)
+	if err != nil {
+		return "", "", err
+	}
+	return access, refresh, nil
+}
+
+// rotateSession exchanges a refresh token for a new access and refresh token.
+// A refresh token is good for one use only: presenting an old one means it
+// was stolen, so the whole session is revoked. The token replaced last is
+// accepted for refreshGrace and only gets an access token.
+func rotateSession(ctx context.Context, r *http.Request, token string) (string, string, error) {
+	sessionID, secret, ok := splitRefreshToken(token)
+	if !ok {
+		return "", "", errInvalidRefreshToken
+	}
+	now := time.Now()
+	presented := hashSecret(secret)
+	refresh, hash := newRefreshToken(sessionID)
+	filter := bson.M{
+		"_id":          sessionID,
+		"refresh_hash": presented,
+		"revoked":      false,
+		"expires_at":   bson.M{"$gt": now},
+	}
+	update := bson.M{"$set": bson.M{
+		"refresh_hash":  hash,
+		"previous_hash": presented,
+		"rotated_at":    now,
+		"last_used":     now,
+		"ip":            clientIP(r),
+		"device":        r.UserAgent(),
+	}}
+	var session Session
+	err := db.Collection("sessions").FindOneAndUpdate(ctx, filter, update, options.FindOneAndUpdate().SetReturnDocument(options.After)).Decode(&session)
+	if err == mongo.ErrNoDocuments {
+		err = db.Collection("sessions").FindOne(ctx, bson.M{"_id": sessionID}).Decode(&session)
+		if err != nil || !withinRefreshGrace(session, presented, now) {
+			db.Collection("sessions").UpdateOne(ctx, bson.M{"_id": sessionID}, bson.M{"$set": bson.M{"revoked": true}})
+			return "", "", errInvalidRefreshToken
+		}
+		refresh = ""
+	} else if err != nil {
+		return "", "", err
+	}
+	// roles are read again so granted and revoked roles apply from the next refresh
+	var user User
+	if err := db.Collection("users").FindOne(ctx, bson.M{"user_id": session.User_id}).Decode(&user); err != nil {
+		return "", "", err
+	}
+	access, err := generateToken(&user, &session)
+	if err != nil {
+		return "", "", err
+	}
+	return access, refresh, nil
+}
+
+// withinRefreshGrace tells whether the refresh token hash is the one the session
+// replaced less than refreshGrace ago, a concurrent request and not a stolen token.
+func withinRefreshGrace(session Session, hash string, now time.Time) bool {
+	return !session.Revoked && session.Previous_hash != "" && session.Previous_hash == hash &&
+		now.Before(session.Rotated_at.Add(refreshGrace)) && now.Before(session.Expires_at)
+}
+
+// renewAccessToken rotates the refresh-token cookie and sets the new tokens as cookies.
+func renewAccessToken(w http.ResponseWriter, r *http.Request) (string, error) {
+	cookie, err := r.Cookie("refresh-token")
+	if err != nil {
+		return "", errInvalidRefreshToken
+	}
+	access, refresh, err := rotateSession(r.Context(), r, cookie.Value)
+	if err != nil {
+		return "", err
+	}
+	setSessionCookies(w, access, refresh)
+	return access, nil
+}
+func sessionActive(ctx context.Context, sessionID string) (bool, error) {
+	if sessionID == "" {
+		return false, nil
+	}
+	count, err := db.Collection("sessions").CountDocuments(ctx, bson.M{"_id": sessionID, "revoked": false, "expires_at": bson.M{"$gt": time.Now()}})
+	return count > 0, err
+}
+func refreshToken(w http.ResponseWriter, r *http.Request) {
+	access, err := renewAccessToken(w, r)
+	if err != nil {
+		clearSessionCookies(w)
+		sendErrorMessage(w, "refreshToken", err, "Session expired. Log in again.")
+		return
+	}
+	sendSuccessMessage(w, "refreshToken", "Token refreshed.", access)
+}
+func logout(w http.ResponseWriter, r *http.Request) {
+	identity, _ := identityFrom(r)
+	_, err := db.Collection("sessions").UpdateOne(r.Context(), bson.M{"_id": identity.Session_id}, bson.M{"$set": bson.M{"revoked": true}})
+	if err != nil {
+		sendErrorMessage(w, "logout", err, "Error logging out. Try again.")
+		return
+	}
+	clearSessionCookies(w)
+	sendSuccessMessage(w, "logout", "Logged out.", "")
+}
+func logoutAll(w http.ResponseWriter, r *http.Request) {
+	userID, err := actingUserID(r, "user_id")
+	if err != nil {
+		sendForbidden(w, "logoutAll", err)
+		return
+	}
+	_, err = db.Collection("sessions").UpdateMany(r.Context(), bson.M{"user_id": userID, "revoked": false}, bson.M{"$set": bson.M{"revoked": true}})
+	if err != nil {
+		sendErrorMessage(w, "logoutAll", err, "Error logging out. Try again.")
+		return
+	}
+	if identity, _ := identityFrom(r); identity.User_id == userID {
+		clearSessionCookies(w)
+	}
+	sendSuccessMessage(w, "logoutAll", "Logged out on all devices.", "")
+}
+func sessions(w http.ResponseWriter, r *http.Request) {
+	userID, err := actingUserID(r, "user_id")
+	if err != nil {
+		sendForbidden(w, "sessions", err)
+		return
+	}
+	list := []Session{}
+	filter := bson.M{"user_id": userID, "revoked": false, "expires_at": bson.M{"$gt": time.Now()}}
+	cursor, err := db.Collection("sessions").Find(r.Context(), filter, options.Find().SetSort(bson.D{{Key: "last_used", Value: -1}}))
+	if err != nil {
+		sendErrorMessage(w, "sessions", err, "Error getting sessions. Try to reload page.")
+		return
+	}
+	if err := cursor.All(r.Context(), &list); err != nil {
+		sendErrorMessage(w, "sessions", err, "Error decoding sessions. Try to reload page.")
+		return
+	}
+	identity, _ := identityFrom(r)
+	for i := range list {
+		list[i].Current = list[i].ID == identity.Session_id
+	}
+	respondWithJSON(w, http.StatusOK, map[string]interface{}{
+		"status":   "success",
+		"sessions": list,
+	})
+}
+func revokeSession(w http.ResponseWriter, r *http.Request) {
+	userID, err := actingUserID(r, "user_id")
+	if err != nil {
+		sendForbidden(w, "revokeSession", err)
+		return
+	}
+	result, err := db.Collection("sessions").UpdateOne(r.Context(), bson.M{"_id": r.URL.Query().Get("id"), "user_id": userID}, bson.M{"$set": bson.M{"revoked": true}})
+	if err != nil {
+		sendErrorMessage(w, "revokeSession", err, "Error revoking session. Try again.")
+		return
+	}
+	if result.MatchedCount == 0 {
+		sendErrorMessage(w, "revokeSession", mongo.ErrNoDocuments, "Session not found.")
+		return
+	}
+	sendSuccessMessage(w, "revokeSession", "Session revoked.", "")
+}
@@ -0,0 +1,336 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Collection sets
+type CardSet struct {
+	ID          string `bson:"_id,omitempty" json:"id"`
+	Set_id      int    `json:"set_id"`
+	Name        string `json:"name"`
+	Description string `json:"description"`
+	Card_ids    []int  `json:"card_ids"`
+	// Criteria sets hold every card matching them, Card_ids is filled in
+	// when the set is read so cards added later count as well.
+	Criteria *SetCriteria `bson:"criteria,omitempty" json:"criteria,omitempty"`
+	// Consume removes the required cards from the collection on claim,
+	// such sets can be claimed again after collecting them once more.
+	Consume      bool `json:"consume"`
+	Reward_coins int  `json:"reward_coins"`
+	Reward_card  int  `json:"reward_card"`
+}
+type SetCriteria struct {
+	Club        string `json:"club,omitempty"`
+	Nationality string `json:"nationality,omitempty"`
+	Position    string `json:"position,omitempty"`
+}
+type SetProgress struct {
+	Set_id   int    `json:"set_id"`
+	Name     string `json:"name"`
+	Owned    int    `json:"owned"`
+	Required int    `json:"required"`
+	Missing  []int  `json:"missing"`
+	Complete bool   `json:"complete"`
+	Claimed  bool   `json:"claimed"`
+}
+type SetClaim struct {
+	ID      string    `bson:"_id,omitempty" json:"-"`
+	User_id string    `json:"user_id"`
+	Set_id  int       `json:"set_id"`
+	Date    time.Time `json:"date"`
+}
+
+var errSetIncomplete = errors.New("set is not complete")
+var errSetClaimed = errors.New("set reward already claimed")
+
+// countCards returns how many copies of every card_id the collection holds.
+func countCards(cards []Card) map[int]int {
+	counts := make(map[int]int)
+	for _, card := range cards {
+		counts[card.Card_id]++
+	}
+	return counts
+}
+
+// takeCards removes the given number of copies of every card_id from cards.
+func takeCards(cards []Card, want map[int]int) ([]Card, error) {
+	left := make(map[int]int)
+	for id, n := range want {
+		left[id] = n
+	}
+	rest := make([]Card, 0, len(cards))
+	for _, card := range cards {
+		if left[card.Card_id] > 0 {
+			left[card.Card_id]--
+			continue
+		}
+		rest = append(rest, card)
+	}
+	for _, n := range left {
+		if n > 0 {
+			return nil, errors.New("collection does not contain the required cards")
+		}
+	}
+	return rest, nil
+}
+
+// filter selects the cards of the criteria, it is empty without any criterion.
+func (criteria SetCriteria) filter() bson.M {
+	filter := bson.M{}
+	if criteria.Club != "" {
+		filter["club"] = criteria.Club
+	}
+	if criteria.Nationality != "" {
+		filter["nationality"] = criteria.Nationality
+	}
+	if criteria.Position != "" {
+		filter["position"] = criteria.Position
+	}
+	return filter
+}
+
+// setCardIDs fills in the cards of criteria sets from the current cards.
+func setCardIDs(ctx context.Context, set *CardSet) error {
+	if set.Criteria == nil {
+		return nil
+	}
+	var cards []Card
+	cursor, err := db.Collection("cards").Find(ctx, set.Criteria.filter(), options.Find().SetProjection(bson.M{"_id": 0, "card_id": 1}))
+	if err != nil {
+		return err
+	}
+	if err := cursor.All(ctx, &cards); err != nil {
+		return err
+	}
+	set.Card_ids = make([]int, 0, len(cards))
+	for _, card := range cards {
+		set.Card_ids = append(set.Card_ids, card.Card_id)
+	}
+	return nil
+}
+func setProgress(set CardSet, counts map[int]int, claimed bool) SetProgress {
+	progress := SetProgress{
+		Set_id:   set.Set_id,
+		Name:     set.Name,
+		Required: len(set.Card_ids),
+		Missing:  []int{},
+		Claimed:  claimed && !set.Consume,
+	}
+	for _, id := range set.Card_ids {
+		if counts[id] > 0 {
+			progress.Owned++
+		} else {
+			progress.Missing = append(progress.Missing, id)
+		}
+	}
+	// a criteria set no card matches yet can not be complete
+	progress.Complete = progress.Required > 0 && progress.Owned == progress.Required
+	return progress
+}
+func getUserCollection(ctx context.Context, userID string) (Collections, error) {
+	var collection Collections
+	err := db.Collection("collections").FindOne(ctx, bson.M{"user_id": userID}, options.FindOne().SetProjection(bson.M{"user_id": 1, "card_id": 1, "_id": 0})).Decode(&collection)
+	return collection, err
+}
+func userSetsProgress(ctx context.Context, userID string) ([]SetProgress, error) {
+	var sets []CardSet
+	cursor, err := db.Collection("card_sets").Find(ctx, bson.M{}, options.Find().SetSort(bson.D{{Key: "set_id", Value: 1}}))
+	if err != nil {
+		return nil, err
+	}
+	if err := cursor.All(ctx, &sets); err != nil {
+		return nil, err
+	}
+	var claims []SetClaim
+	cursor, err = db.Collection("set_claims").Find(ctx, bson.M{"user_id": userID})
+	if err != nil {
+		return nil, err
+	}
+	if err := cursor.All(ctx, &claims); err != nil {
+		return nil, err
+	}
+	claimed := make(map[int]bool)
+	for _, claim := range claims {
+		claimed[claim.Set_id] = true
+	}
+	collection, err := getUserCollection(ctx, userID)
+	if err != nil && err != mongo.ErrNoDocuments {
+		return nil, err
+	}
+	counts := countCards(collection.Card_id)
+	progress := make([]SetProgress, 0, len(sets))
+	for _, set := range sets {
+		if err := setCardIDs(ctx, &set); err != nil {
+			return nil, err
+		}
+		progress = append(progress, setProgress(set, counts, claimed[set.Set_id]))
+	}
+	return progress, nil
+}
+func addSet(w http.ResponseWriter, r *http.Request) {
+	type newSet struct {
+		Name         string `json:"name"`
+		Description  string `json:"description"`
+		Card_ids     []int  `json:"card_ids"`
+		Club         string `json:"club"`
+		Nationality  string `json:"nationality"`
+		Position     string `json:"position"`
+		Consume      bool   `json:"consume"`
+		Reward_coins int    `json:"reward_coins"`
+		Reward_card  int    `json:"reward_card"`
+	}
+	var data newSet
+	err := json.NewDecoder(r.Body).Decode(&data)
+	if err != nil {
+		sendErrorMessage(w, "addSet", err, "Error decoding new set data. Try again.")
+		return
+	}
+	if data.Name == "" {
+		sendErrorMessage(w, "addSet", errors.New("invalid input"), "Set name is required.")
+		return
+	}
+	// A set is either an explicit list of cards or every card matching the
+	// criteria, including cards added after the set.
+	set := CardSet{Card_ids: data.Card_ids}
+	if len(set.Card_ids) == 0 {
+		criteria := SetCriteria{Club: data.Club, Nationality: data.Nationality, Position: data.Position}
+		if len(criteria.filter()) == 0 {
+			sendErrorMessage(w, "addSet", errors.New("invalid input"), "Set needs card_ids or at least one of club, nationality, position.")
+			return
+		}
+		set.Criteria = &criteria
+		if err := setCardIDs(r.Context(), &set); err != nil {
+			sendErrorMessage(w, "addSet", err, "Error getting cards for the set. Try again.")
+			return
+		}
+	}
+	if len(set.Card_ids) == 0 {
+		sendErrorMessage(w, "addSet", errors.New("invalid input"), "No cards match the set.")
+		return
+	}
+	if set.Criteria != nil {
+		set.Card_ids = nil
+	}
+	id, err := db.Collection("card_sets").CountDocuments(r.Context(), bson.M{})
+	if err != nil {
+		sendErrorMessage(w, "addSet", err, "Error get size of sets collection. Try again.")
+		return
+	}
+	set.Set_id = int(id + 1)
+	set.Name = data.Name
+	set.Description = data.Description
+	set.Consume = data.Consume
+	set.Reward_coins = data.Reward_coins
+	set.Reward_card = data.Reward_card
+	_, err = db.Collection("card_sets").InsertOne(r.Context(), set)
+	if err != nil {
+		sendErrorMessage(w, "addSet", err, "Error adding new set. Try again.")
+		return
+	}
+	sendSuccessMessage(w, "addSet", "New set "+set.Name+" added successfully!", "")
+}
+func sets(w http.ResponseWriter, r *http.Request) {
+	userID, err := actingUserID(r, "user_id")
+	if err != nil {
+		sendForbidden(w, "sets", err)
+		return
+	}
+	progress, err := userSetsProgress(r.Context(), userID)
+	if err != nil {
+		sendErrorMessage(w, "sets", err, "Error getting sets progress. Try to reload page.")
+		return
+	}
+	respondWithJSON(w, http.StatusOK, map[string]interface{}{
+		"status": "success",
+		"sets":   progress,
+	})
+}
+func claimSet(w http.ResponseWriter, r *http.Request) {
+	userID, err := actingUserID(r, "user_id")
+	if err != nil {
+		sendForbidden(w, "claimSet", err)
+		return
+	}
+	setID, err := strconv.Atoi(r.URL.Query().Get("set_id"))
+	if err != nil {
+		sendErrorMessage(w, "claimSet", err, "Invalid set_id parameter. Try again.")
+		return
+	}
+	var set CardSet
+	err = db.Collection("card_sets").FindOne(r.Context(), bson.M{"set_id": setID}).Decode(&set)
+	if err != nil {
+		sendErrorMessage(w, "claimSet", err, "Set not found. Try again.")
+		return
+	}
+	if err := setCardIDs(r.Context(), &set); err != nil {
+		sendErrorMessage(w, "claimSet", err, "Error getting cards for the set. Try again.")
+		return
+	}
+	err = withTransaction(r.Context(), func(sc mongo.SessionContext) error {
+		collection, err := getUserCollection(sc, userID)
+		if err != nil {
+			return err
+		}
+		counts := countCards(collection.Card_id)
+		if !setProgress(set, counts, false).Complete {
+			return errSetIncomplete
+		}
+		if set.Consume {
+			want := make(map[int]int)
+			for _, id := range set.Card_ids {
+				want[id]++
+			}
+			rest, err := takeCards(collection.Card_id, want)
+			if err != nil {
+				return err
+			}
+			_, err = db.Collection("collections").UpdateOne(sc, bson.M{"user_id": userID}, bson.M{"$set": bson.M{"card_id": rest}})
+			if err != nil {
+				return err
+			}
+		}
+		claim := SetClaim{User_id: userID, Set_id: setID, Date: time.Now()}
+		if !set.Consume {
+			// fixed _id lets the unique _id index reject a second claim
+			claim.ID = userID + ":" + strconv.Itoa(setID)
+		}
+		_, err = db.Collection("set_claims").InsertOne(sc, claim)
+		if mongo.IsDuplicateKeyError(err) {
+			return errSetClaimed
+		}
+		if err != nil {
+			return err
+		}
+		if set.Reward_card != 0 {
+			var card Card
+			err = db.Collection("cards").FindOne(sc, bson.M{"card_id": set.Reward_card}, options.FindOne().SetProjection(bson.M{"_id": 0})).Decode(&card)
+			if err != nil {
+				return err
+			}
+			_, err = db.Collection("collections").UpdateOne(sc, bson.M{"user_id": userID}, bson.M{"$push": bson.M{"card_id": card}})
+			if err != nil {
+				return err
+			}
+		}
+		return changeCoins(sc, userID, set.Reward_coins, "set:"+strconv.Itoa(setID))
+	})
+	if err == errSetIncomplete || err == errSetClaimed {
+		sendErrorMessage(w, "claimSet", err, "Can not claim "+set.Name+": "+err.Error()+".")
+		return
+	}
+	if err != nil {
+		sendErrorMessage(w, "claimSet", err, "Error claiming set reward. Try again.")
+		return
+	}
+	sendSuccessMessage(w, "claimSet", "Reward for the set "+set.Name+" was claimed successfully!", "")
+}
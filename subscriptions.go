@@ -0,0 +1,372 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"html/template"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Email subscriptions
+const (
+	topicNewCards      = "new_cards"
+	topicMarketAlerts  = "market_alerts"
+	topicLeagueResults = "league_results"
+	topicMarketing     = "marketing"
+)
+
+// emailTopics are the bulk email topics and whether users get them without choosing, marketing is opt-in.
+var emailTopics = map[string]bool{
+	topicNewCards:      true,
+	topicMarketAlerts:  true,
+	topicLeagueResults: true,
+	topicMarketing:     false,
+}
+
+// Campaign records a bulk send, the mail workers queue its emails and count Sent and Failed.
+type Campaign struct {
+	ID         primitive.ObjectID     `bson:"_id,omitempty" json:"id"`
+	Name       string                 `json:"name"`
+	Topic      string                 `json:"topic"`
+	Data       map[string]interface{} `json:"-"`
+	Status     string                 `json:"status"`
+	Queued     int                    `json:"queued"`
+	Skipped    int                    `json:"skipped"`
+	Sent       int                    `json:"sent"`
+	Failed     int                    `json:"failed"`
+	Created_at time.Time              `json:"created_at"`
+	// Last_user is the _id of the last user queued, a worker taking over
+	// a stopped fan-out goes on after it.
+	Last_user    primitive.ObjectID `bson:"last_user,omitempty" json:"-"`
+	Locked_until time.Time          `json:"-"`
+}
+
+const (
+	campaignPending  = "pending"
+	campaignQueueing = "queueing"
+	campaignQueued   = "queued"
+)
+
+// campaignBatch emails are queued at once.
+const campaignBatch = 500
+
+var errInvalidUnsubscribe = errors.New("invalid unsubscribe link")
+var errCampaignTaken = errors.New("campaign is queued by another worker")
+
+// wantsEmail tells whether the user gets bulk emails of the topic.
+func wantsEmail(user User, topic string) bool {
+	if subscribed, ok := user.Email_preferences[topic]; ok {
+		return subscribed
+	}
+	return emailTopics[topic]
+}
+
+// subscribedFilter selects the users getting bulk emails of the topic.
+func subscribedFilter(topic string) bson.M {
+	field := "email_preferences." + topic
+	if emailTopics[topic] {
+		return bson.M{field: bson.M{"$ne": false}}
+	}
+	return bson.M{field: true}
+}
+
+// emailPreferences returns the preference of every topic for the user.
+func emailPreferences(user User) map[string]bool {
+	preferences := map[string]bool{}
+	for topic := range emailTopics {
+		preferences[topic] = wantsEmail(user, topic)
+	}
+	return preferences
+}
+
+// unsubscribeSignature signs the user and topic with a token signing key, the
+// kid is part of the link so links keep working until the key is dropped.
+func unsubscribeSignature(kid string, payload string) (string, bool) {
+	key, ok := tokenKeys.Keys[kid]
+	if !ok {
+		return "", false
+	}
+	mac := hmac.New(sha256.New, append([]byte("unsubscribe:"), key...))
+	mac.Write([]byte(payload))
+	return hex.EncodeToString(mac.Sum(nil)), true
+}
+
+// unsubscribeToken is "<base64 user_id:topic>.<kid>.<signature>".
+func unsubscribeToken(userID string, topic string) (string, error) {
+	payload := base64.RawURLEncoding.EncodeToString([]byte(userID + ":" + topic))
+	signature, ok := unsubscribeSignature(tokenKeys.Active, payload)
+	if !ok {
+		return "", errNoSigningKey
+	}
+	return payload + "." + tokenKeys.Active + "." + signature, nil
+}
+func parseUnsubscribeToken(token string) (string, string, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return "", "", errInvalidUnsubscribe
+	}
+	expected, ok := unsubscribeSignature(parts[1], parts[0])
+	if !ok || !hmac.Equal([]byte(expected), []byte(parts[2])) {
+		return "", "", errInvalidUnsubscribe
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return "", "", errInvalidUnsubscribe
+	}
+	userID, topic, ok := strings.Cut(string(payload), ":")
+	if _, known := emailTopics[topic]; !ok || !known {
+		return "", "", errInvalidUnsubscribe
+	}
+	return userID, topic, nil
+}
+func unsubscribeURL(userID string, topic string) (string, error) {
+	token, err := unsubscribeToken(userID, topic)
+	if err != nil {
+		return "", err
+	}
+	return appURL() + "/unsubscribe?token=" + url.QueryEscape(token), nil
+}
+
+// newsLetter records a campaign of the named email for every user subscribed
+// to the topic, the mail workers queue the emails with fanOutCampaign.
+func newsLetter(ctx context.Context, topic string, name string, data map[string]interface{}) (Campaign, error) {
+	campaign := Campaign{ID: primitive.NewObjectID(), Name: name, Topic: topic, Data: data, Status: campaignPending, Created_at: time.Now()}
+	_, err := db.Collection("campaigns").InsertOne(ctx, campaign)
+	return campaign, err
+}
+
+// claimCampaign takes the next campaign to queue. A campaign left queueing
+// by a stopped worker is claimed again once its lock ran out.
+func claimCampaign(ctx context.Context) (Campaign, error) {
+	now := time.Now()
+	filter := bson.M{"$or": bson.A{
+		bson.M{"status": campaignPending},
+		bson.M{"status": campaignQueueing, "locked_until": bson.M{"$lte": now}},
+	}}
+	update := bson.M{"$set": bson.M{"status": campaignQueueing, "locked_until": now.Add(mailSendTimeout)}}
+	opts := options.FindOneAndUpdate().SetSort(bson.D{{Key: "created_at", Value: 1}}).SetReturnDocument(options.After)
+	var campaign Campaign
+	err := db.Collection("campaigns").FindOneAndUpdate(ctx, filter, update, opts).Decode(&campaign)
+	return campaign, err
+}
+
+// fanOutCampaign queues the email of a claimed campaign for every subscribed
+// user, in their language and with their unsubscribe link. Each batch is
+// queued together with the progress of the campaign, so a worker taking
+// over does not queue an email twice.
+func fanOutCampaign(ctx context.Context, campaign Campaign) error {
+	filter := subscribedFilter(campaign.Topic)
+	if !campaign.Last_user.IsZero() {
+		filter["_id"] = bson.M{"$gt": campaign.Last_user}
+	}
+	opts := options.Find().SetSort(bson.D{{Key: "_id", Value: 1}}).SetProjection(bson.M{"user_id": 1, "email": 1, "language": 1})
+	cursor, err := db.Collection("users").Find(ctx, filter, opts)
+	if err != nil {
+		return err
+	}
+	defer cursor.Close(ctx)
+	var batch []Email
+	var lastUser primitive.ObjectID
+	// progress matches the campaign while no other worker queued from it
+	progress := func() bson.M {
+		if campaign.Last_user.IsZero() {
+			return bson.M{"_id": campaign.ID, "last_user": bson.M{"$exists": false}}
+		}
+		return bson.M{"_id": campaign.ID, "last_user": campaign.Last_user}
+	}
+	flush := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		err := withTransaction(ctx, func(sc mongo.SessionContext) error {
+			update := bson.M{
+				"$inc": bson.M{"queued": len(batch)},
+				"$set": bson.M{"last_user": lastUser, "locked_until": time.Now().Add(mailSendTimeout)},
+			}
+			result, err := db.Collection("campaigns").UpdateOne(sc, progress(), update)
+			if err != nil {
+				return err
+			}
+			if result.MatchedCount == 0 {
+				return errCampaignTaken
+			}
+			return enqueueCampaignEmails(sc, campaign.ID.Hex(), batch)
+		})
+		if err != nil {
+			return err
+		}
+		campaign.Queued += len(batch)
+		campaign.Last_user = lastUser
+		batch = nil
+		return nil
+	}
+	for cursor.Next(ctx) {
+		var user User
+		if err := cursor.Decode(&user); err != nil {
+			return err
+		}
+		link, err := unsubscribeURL(user.User_id, campaign.Topic)
+		if err != nil {
+			return err
+		}
+		userData := map[string]interface{}{"Unsubscribe": link}
+		for key, value := range campaign.Data {
+			userData[key] = value
+		}
+		email, err := renderEmail(campaign.Name, userLanguage(user), user.Email, userData)
+		if err != nil {
+			return err
+		}
+		batch = append(batch, email)
+		if lastUser, err = primitive.ObjectIDFromHex(user.ID); err != nil {
+			return err
+		}
+		if len(batch) == campaignBatch {
+			if err := flush(); err != nil {
+				return err
+			}
+		}
+	}
+	if err := cursor.Err(); err != nil {
+		return err
+	}
+	if err := flush(); err != nil {
+		return err
+	}
+	total, err := db.Collection("users").CountDocuments(ctx, bson.M{})
+	if err != nil {
+		return err
+	}
+	update := bson.M{"$set": bson.M{"status": campaignQueued, "skipped": int(total) - campaign.Queued}}
+	_, err = db.Collection("campaigns").UpdateOne(ctx, progress(), update)
+	return err
+}
+
+// countCampaignDelivery counts a sent or dead-lettered email of a campaign.
+func countCampaignDelivery(ctx context.Context, campaignID string, field string, delta int) {
+	id, err := primitive.ObjectIDFromHex(campaignID)
+	if err != nil {
+		return
+	}
+	if _, err := db.Collection("campaigns").UpdateOne(ctx, bson.M{"_id": id}, bson.M{"$inc": bson.M{field: delta}}); err != nil {
+		logger.WithFields(logrus.Fields{
+			"action": "countCampaignDelivery",
+			"status": "error",
+			"error":  err.Error(),
+		}).Error("Error counting campaign delivery")
+	}
+}
+func campaigns(w http.ResponseWriter, r *http.Request) {
+	list := []Campaign{}
+	cursor, err := db.Collection("campaigns").Find(r.Context(), bson.M{}, options.Find().SetSort(bson.D{{Key: "created_at", Value: -1}}).SetLimit(50))
+	if err != nil {
+		sendErrorMessage(w, "campaigns", err, "Error getting campaigns. Try to reload page.")
+		return
+	}
+	if err := cursor.All(r.Context(), &list); err != nil {
+		sendErrorMessage(w, "campaigns", err, "Error decoding campaigns. Try to reload page.")
+		return
+	}
+	respondWithJSON(w, http.StatusOK, map[string]interface{}{
+		"status":    "success",
+		"campaigns": list,
+	})
+}
+func getEmailPreferences(w http.ResponseWriter, r *http.Request) {
+	userID, err := actingUserID(r, "user_id")
+	if err != nil {
+		sendForbidden(w, "getEmailPreferences", err)
+		return
+	}
+	var user User
+	if err := db.Collection("users").FindOne(r.Context(), bson.M{"user_id": userID}).Decode(&user); err != nil {
+		sendErrorMessage(w, "getEmailPreferences", err, "User not found.")
+		return
+	}
+	respondWithJSON(w, http.StatusOK, map[string]interface{}{
+		"status":      "success",
+		"preferences": emailPreferences(user),
+	})
+}
+func setEmailPreferences(w http.ResponseWriter, r *http.Request) {
+	userID, err := actingUserID(r, "user_id")
+	if err != nil {
+		sendForbidden(w, "setEmailPreferences", err)
+		return
+	}
+	var preferences map[string]bool
+	if err := json.NewDecoder(r.Body).Decode(&preferences); err != nil {
+		sendErrorMessage(w, "setEmailPreferences", err, "Error decoding preferences. Try again.")
+		return
+	}
+	set := bson.M{}
+	for topic, subscribed := range preferences {
+		if _, ok := emailTopics[topic]; !ok {
+			sendErrorMessage(w, "setEmailPreferences", errors.New("invalid input"), "Unknown topic "+topic+".")
+			return
+		}
+		set["email_preferences."+topic] = subscribed
+	}
+	if len(set) == 0 {
+		sendErrorMessage(w, "setEmailPreferences", errors.New("invalid input"), "Nothing to change.")
+		return
+	}
+	_, err = db.Collection("users").UpdateOne(r.Context(), bson.M{"user_id": userID}, bson.M{"$set": set})
+	if err != nil {
+		sendErrorMessage(w, "setEmailPreferences", err, "Error saving preferences. Try again.")
+		return
+	}
+	sendSuccessMessage(w, "setEmailPreferences", "Preferences saved.", "")
+}
+
+// unsubscribePage asks to confirm, mail scanners following links must not unsubscribe anybody.
+func unsubscribePage(w http.ResponseWriter, r *http.Request) {
+	_, topic, err := parseUnsubscribeToken(r.URL.Query().Get("token"))
+	if err != nil {
+		http.Error(w, "Invalid unsubscribe link", http.StatusBadRequest)
+		return
+	}
+	tmpl, err := template.ParseFiles("unsubscribe.html")
+	if err != nil {
+		logger.WithFields(logrus.Fields{
+			"action": "unsubscribePage",
+			"status": "error",
+			"error":  err.Error(),
+		}).Error("Error parsing template file 'unsubscribe.html'")
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	tmpl.ExecuteTemplate(w, "unsubscribe.html", map[string]string{
+		"Token": r.URL.Query().Get("token"),
+		"Topic": strings.ReplaceAll(topic, "_", " "),
+	})
+}
+
+// unsubscribe is the one-click POST of the unsubscribe link, it needs no login.
+func unsubscribe(w http.ResponseWriter, r *http.Request) {
+	userID, topic, err := parseUnsubscribeToken(r.URL.Query().Get("token"))
+	if err != nil {
+		sendErrorMessage(w, "unsubscribe", err, "The unsubscribe link is invalid.")
+		return
+	}
+	_, err = db.Collection("users").UpdateOne(r.Context(), bson.M{"user_id": userID}, bson.M{"$set": bson.M{"email_preferences." + topic: false}})
+	if err != nil && err != mongo.ErrNoDocuments {
+		sendErrorMessage(w, "unsubscribe", err, "Error unsubscribing. Try again.")
+		return
+	}
+	sendSuccessMessage(w, "unsubscribe", "You will not get these emails any more.", "")
+}
@@ -0,0 +1,421 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Support queue
+type ChatTransfer struct {
+	From string    `bson:"from" json:"from"`
+	To   string    `bson:"to" json:"to"`
+	At   time.Time `bson:"at" json:"at"`
+}
+
+// SupportAgent is written on every assignment to the agent, Max_chats overrides SUPPORT_MAX_CHATS.
+type SupportAgent struct {
+	ID               string    `bson:"_id" json:"id"`
+	Max_chats        int       `bson:"max_chats,omitempty" json:"max_chats"`
+	Last_assigned_at time.Time `bson:"last_assigned_at,omitempty" json:"last_assigned_at"`
+}
+
+type AgentMetrics struct {
+	Agent_id string `json:"agent_id"`
+	Open     int    `json:"open"`
+	Resolved int    `json:"resolved"`
+	Limit    int    `json:"limit"`
+}
+
+type SupportMetrics struct {
+	From                       time.Time      `json:"from"`
+	Chats                      int            `json:"chats"`
+	Waiting                    int            `json:"waiting"`
+	Open                       int            `json:"open"`
+	Resolved                   int            `json:"resolved"`
+	Oldest_waiting_seconds     float64        `json:"oldest_waiting_seconds"`
+	Avg_first_response_seconds float64        `json:"avg_first_response_seconds"`
+	Avg_resolution_seconds     float64        `json:"avg_resolution_seconds"`
+	First_response_breaches    int            `json:"first_response_breaches"`
+	Resolution_breaches        int            `json:"resolution_breaches"`
+	Agents                     []AgentMetrics `json:"agents"`
+}
+
+var maxAgentChats = envInt("SUPPORT_MAX_CHATS", 5)
+var slaFirstResponse = time.Duration(envInt("SLA_FIRST_RESPONSE_MINUTES", 5)) * time.Minute
+var slaResolution = time.Duration(envInt("SLA_RESOLUTION_MINUTES", 60)) * time.Minute
+
+var errChatNotQueued = errors.New("chat is not waiting in the queue")
+var errChatNotAssigned = errors.New("chat is not handled by the agent")
+var errAgentBusy = errors.New("agent handles the maximum number of chats")
+var errNotAgent = errors.New("user is not a support agent")
+
+// queueOrder serves the chats first come, first served.
+var queueOrder = bson.D{{Key: "created_at", Value: 1}, {Key: "_id", Value: 1}}
+
+func queuedFilter() bson.M {
+	return bson.M{"is_finished": false, "id_support": bson.M{"$in": bson.A{"", nil}}}
+}
+
+// backfillChatCreatedAt dates the chats opened before the queue from their _id.
+func backfillChatCreatedAt(ctx context.Context) {
+	update := bson.A{bson.M{"$set": bson.M{"created_at": bson.M{"$toDate": "$_id"}}}}
+	_, err := db.Collection("chats").UpdateMany(ctx, bson.M{"created_at": bson.M{"$exists": false}}, update)
+	if err != nil {
+		logger.WithFields(logrus.Fields{
+			"action": "backfillChatCreatedAt",
+			"status": "error",
+			"error":  err.Error(),
+		}).Error("Error dating old chats")
+	}
+}
+
+// reserveAgent checks the agent has room for one more chat. It writes the agent
+// document first, so concurrent assignments to the same agent conflict and the
+// transaction is retried instead of both passing the limit.
+func reserveAgent(sc mongo.SessionContext, agentID string, now time.Time) error {
+	var agent SupportAgent
+	opts := options.FindOneAndUpdate().SetUpsert(true).SetReturnDocument(options.After)
+	err := db.Collection("support_agents").FindOneAndUpdate(sc, bson.M{"_id": agentID}, bson.M{"$set": bson.M{"last_assigned_at": now}}, opts).Decode(&agent)
+	if err != nil {
+		return err
+	}
+	open, err := db.Collection("chats").CountDocuments(sc, bson.M{"id_support": agentID, "is_finished": false})
+	if err != nil {
+		return err
+	}
+	if open >= int64(agentLimit(agent)) {
+		return errAgentBusy
+	}
+	return nil
+}
+func agentLimit(agent SupportAgent) int {
+	if agent.Max_chats > 0 {
+		return agent.Max_chats
+	}
+	return maxAgentChats
+}
+
+// claimChat assigns a waiting chat to the agent, the one waiting longest for a zero chatID.
+func claimChat(ctx context.Context, agentID string, chatID primitive.ObjectID) (Chat, error) {
+	var chat Chat
+	err := withTransaction(ctx, func(sc mongo.SessionContext) error {
+		now := time.Now()
+		if err := reserveAgent(sc, agentID, now); err != nil {
+			return err
+		}
+		filter := queuedFilter()
+		if !chatID.IsZero() {
+			filter["_id"] = chatID
+		}
+		update := bson.M{"$set": bson.M{"id_support": agentID, "assigned_at": now}}
+		opts := options.FindOneAndUpdate().SetSort(queueOrder).SetReturnDocument(options.After).SetProjection(bson.M{"messages": 0})
+		err := db.Collection("chats").FindOneAndUpdate(sc, filter, update, opts).Decode(&chat)
+		if err == mongo.ErrNoDocuments {
+			return errChatNotQueued
+		}
+		return err
+	})
+	return chat, err
+}
+
+// releaseChat puts the chat of the agent back in the queue, it keeps its place by creation time.
+func releaseChat(ctx context.Context, agentID string, chatID primitive.ObjectID) error {
+	filter := bson.M{"_id": chatID, "is_finished": false, "id_support": agentID}
+	update := bson.M{"$set": bson.M{"id_support": ""}, "$unset": bson.M{"assigned_at": ""}}
+	result, err := db.Collection("chats").UpdateOne(ctx, filter, update)
+	if err != nil {
+		return err
+	}
+	if result.MatchedCount == 0 {
+		return errChatNotAssigned
+	}
+	chatRooms.kick(chatID.Hex(), chatRoleSupport)
+	return nil
+}
+
+// transferChat hands the chat of one agent to another support agent with room for it.
+func transferChat(ctx context.Context, from string, to string, chatID primitive.ObjectID) error {
+	toID, err := primitive.ObjectIDFromHex(to)
+	if err != nil || to == from {
+		return errNotAgent
+	}
+	var user User
+	if err := db.Collection("users").FindOne(ctx, bson.M{"_id": toID}).Decode(&user); err != nil {
+		return errNotAgent
+	}
+	if !hasPermission(userRoles(user), permSupport) {
+		return errNotAgent
+	}
+	err = withTransaction(ctx, func(sc mongo.SessionContext) error {
+		now := time.Now()
+		if err := reserveAgent(sc, to, now); err != nil {
+			return err
+		}
+		filter := bson.M{"_id": chatID, "is_finished": false, "id_support": from}
+		update := bson.M{
+			"$set":  bson.M{"id_support": to, "assigned_at": now},
+			"$push": bson.M{"transfers": ChatTransfer{From: from, To: to, At: now}},
+		}
+		result, err := db.Collection("chats").UpdateOne(sc, filter, update)
+		if err != nil {
+			return err
+		}
+		if result.MatchedCount == 0 {
+			return errChatNotAssigned
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	chatRooms.kick(chatID.Hex(), chatRoleSupport)
+	notifyUser(ctx, user.User_id, notifyChatAssigned, "A support chat was transferred to you.", "/admin")
+	return nil
+}
+
+// markFirstResponse records the first support message of the chat.
+func markFirstResponse(ctx context.Context, chatID primitive.ObjectID, at time.Time) error {
+	filter := bson.M{"_id": chatID, "first_response_at": bson.M{"$exists": false}}
+	_, err := db.Collection("chats").UpdateOne(ctx, filter, bson.M{"$set": bson.M{"first_response_at": at}})
+	return err
+}
+
+// firstResponseTime is how long the client waited for an answer, so far for an
+// unanswered open chat. Old finished chats without timestamps are not counted.
+func firstResponseTime(chat Chat, now time.Time) (time.Duration, bool) {
+	switch {
+	case !chat.First_response_at.IsZero():
+		return chat.First_response_at.Sub(chat.Created_at), true
+	case !chat.Is_finished:
+		return now.Sub(chat.Created_at), false
+	case !chat.Finished_at.IsZero():
+		return chat.Finished_at.Sub(chat.Created_at), false
+	}
+	return 0, false
+}
+
+// resolutionTime is how long the chat took to close, so far for an open chat.
+func resolutionTime(chat Chat, now time.Time) (time.Duration, bool) {
+	if !chat.Is_finished {
+		return now.Sub(chat.Created_at), false
+	}
+	if chat.Finished_at.IsZero() {
+		return 0, false
+	}
+	return chat.Finished_at.Sub(chat.Created_at), true
+}
+
+// supportMetricsOf sums up the chats. Averages count answered and closed chats,
+// breaches also count chats still waiting past the SLA.
+func supportMetricsOf(chats []Chat, limits map[string]int, from time.Time, now time.Time) SupportMetrics {
+	metrics := SupportMetrics{From: from, Chats: len(chats), Agents: []AgentMetrics{}}
+	agents := map[string]*AgentMetrics{}
+	agent := func(id string) *AgentMetrics {
+		if agents[id] == nil {
+			limit := maxAgentChats
+			if limits[id] > 0 {
+				limit = limits[id]
+			}
+			agents[id] = &AgentMetrics{Agent_id: id, Limit: limit}
+		}
+		return agents[id]
+	}
+	var responses, resolutions int
+	var responseTotal, resolutionTotal time.Duration
+	for _, chat := range chats {
+		switch {
+		case chat.Is_finished:
+			metrics.Resolved++
+			if chat.Id_support != "" {
+				agent(chat.Id_support).Resolved++
+			}
+		case chat.Id_support == "":
+			metrics.Waiting++
+			if wait := now.Sub(chat.Created_at).Seconds(); wait > metrics.Oldest_waiting_seconds {
+				metrics.Oldest_waiting_seconds = wait
+			}
+		default:
+			metrics.Open++
+			agent(chat.Id_support).Open++
+		}
+		if wait, answered := firstResponseTime(chat, now); wait > 0 {
+			if answered {
+				responses++
+				responseTotal += wait
+			}
+			if wait > slaFirstResponse {
+				metrics.First_response_breaches++
+			}
+		}
+		if took, closed := resolutionTime(chat, now); took > 0 {
+			if closed {
+				resolutions++
+				resolutionTotal += took
+			}
+			if took > slaResolution {
+				metrics.Resolution_breaches++
+			}
+		}
+	}
+	if responses > 0 {
+		metrics.Avg_first_response_seconds = responseTotal.Seconds() / float64(responses)
+	}
+	if resolutions > 0 {
+		metrics.Avg_resolution_seconds = resolutionTotal.Seconds() / float64(resolutions)
+	}
+	for _, a := range agents {
+		metrics.Agents = append(metrics.Agents, *a)
+	}
+	sort.Slice(metrics.Agents, func(i, j int) bool { return metrics.Agents[i].Agent_id < metrics.Agents[j].Agent_id })
+	return metrics
+}
+
+// sendQueueError answers the errors of the queue operations.
+func sendQueueError(w http.ResponseWriter, action string, err error) {
+	switch err {
+	case errChatNotQueued:
+		sendErrorMessage(w, action, err, "The chat is finished or handled by another agent.")
+	case errChatNotAssigned:
+		sendErrorMessage(w, action, err, "The chat is finished or not handled by you.")
+	case errAgentBusy:
+		sendErrorMessage(w, action, err, "The agent handles the maximum number of chats. Close or release a chat first.")
+	case errNotAgent:
+		sendErrorMessage(w, action, err, "The chat can only be transferred to another support agent.")
+	default:
+		sendErrorMessage(w, action, err, "Error updating chat. Try again.")
+	}
+}
+
+// claimQueuedChat takes the chat of the chat_id parameter, or the next chat of the queue without it.
+func claimQueuedChat(w http.ResponseWriter, r *http.Request) {
+	agentID, err := actingAccountID(r, "id")
+	if err != nil {
+		sendForbidden(w, "claimQueuedChat", err)
+		return
+	}
+	var chatID primitive.ObjectID
+	if param := r.URL.Query().Get("chat_id"); param != "" {
+		chatID, err = primitive.ObjectIDFromHex(param)
+		if err != nil {
+			sendErrorMessage(w, "claimQueuedChat", err, "Invalid chat ID.")
+			return
+		}
+	}
+	chat, err := claimChat(r.Context(), agentID, chatID)
+	if err != nil {
+		sendQueueError(w, "claimQueuedChat", err)
+		return
+	}
+	respondWithJSON(w, http.StatusOK, map[string]interface{}{
+		"status": "success",
+		"chat":   chat,
+	})
+}
+func releaseQueuedChat(w http.ResponseWriter, r *http.Request) {
+	agentID, err := actingAccountID(r, "id")
+	if err != nil {
+		sendForbidden(w, "releaseQueuedChat", err)
+		return
+	}
+	chatID, err := primitive.ObjectIDFromHex(r.URL.Query().Get("chat_id"))
+	if err != nil {
+		sendErrorMessage(w, "releaseQueuedChat", err, "Invalid chat ID.")
+		return
+	}
+	if err := releaseChat(r.Context(), agentID, chatID); err != nil {
+		sendQueueError(w, "releaseQueuedChat", err)
+		return
+	}
+	sendSuccessMessage(w, "releaseQueuedChat", "The chat is back in the queue.", "")
+}
+func transferQueuedChat(w http.ResponseWriter, r *http.Request) {
+	agentID, err := actingAccountID(r, "id")
+	if err != nil {
+		sendForbidden(w, "transferQueuedChat", err)
+		return
+	}
+	chatID, err := primitive.ObjectIDFromHex(r.URL.Query().Get("chat_id"))
+	if err != nil {
+		sendErrorMessage(w, "transferQueuedChat", err, "Invalid chat ID.")
+		return
+	}
+	if err := transferChat(r.Context(), agentID, r.URL.Query().Get("to"), chatID); err != nil {
+		sendQueueError(w, "transferQueuedChat", err)
+		return
+	}
+	sendSuccessMessage(w, "transferQueuedChat", "The chat was transferred.", "")
+}
+
+// setAgentLimit sets the concurrent chat limit of an agent, max_chats=0 restores the default.
+func setAgentLimit(w http.ResponseWriter, r *http.Request) {
+	agentID := r.URL.Query().Get("agent_id")
+	if _, err := primitive.ObjectIDFromHex(agentID); err != nil {
+		sendErrorMessage(w, "setAgentLimit", err, "Invalid agent ID.")
+		return
+	}
+	limit, err := strconv.Atoi(r.URL.Query().Get("max_chats"))
+	if err != nil || limit < 0 {
+		sendErrorMessage(w, "setAgentLimit", errors.New("invalid input"), "Invalid limit. The limit must be zero or a positive number of chats.")
+		return
+	}
+	_, err = db.Collection("support_agents").UpdateOne(r.Context(), bson.M{"_id": agentID}, bson.M{"$set": bson.M{"max_chats": limit}}, options.Update().SetUpsert(true))
+	if err != nil {
+		sendErrorMessage(w, "setAgentLimit", err, "Error saving limit. Try again.")
+		return
+	}
+	sendSuccessMessage(w, "setAgentLimit", "Agent limit saved.", "")
+}
+
+// supportMetrics reports the queue and the SLA of the chats opened in the last days (7 by default) and of every open chat.
+func supportMetrics(w http.ResponseWriter, r *http.Request) {
+	days := 7
+	if param := r.URL.Query().Get("days"); param != "" {
+		var err error
+		days, err = strconv.Atoi(param)
+		if err != nil || days < 1 {
+			sendErrorMessage(w, "supportMetrics", errors.New("invalid input"), "Invalid days parameter.")
+			return
+		}
+	}
+	now := time.Now()
+	from := now.AddDate(0, 0, -days)
+	filter := bson.M{"$or": bson.A{bson.M{"created_at": bson.M{"$gte": from}}, bson.M{"is_finished": false}}}
+	var chats []Chat
+	cursor, err := db.Collection("chats").Find(r.Context(), filter, options.Find().SetProjection(bson.M{"messages": 0}))
+	if err == nil {
+		err = cursor.All(r.Context(), &chats)
+	}
+	if err != nil {
+		sendErrorMessage(w, "supportMetrics", err, "Error getting chats. Try to reload page.")
+		return
+	}
+	var agents []SupportAgent
+	cursor, err = db.Collection("support_agents").Find(r.Context(), bson.M{})
+	if err == nil {
+		err = cursor.All(r.Context(), &agents)
+	}
+	if err != nil {
+		sendErrorMessage(w, "supportMetrics", err, "Error getting agents. Try to reload page.")
+		return
+	}
+	limits := map[string]int{}
+	for _, agent := range agents {
+		limits[agent.ID] = agent.Max_chats
+	}
+	respondWithJSON(w, http.StatusOK, map[string]interface{}{
+		"status":                     "success",
+		"metrics":                    supportMetricsOf(chats, limits, from, now),
+		"sla_first_response_minutes": slaFirstResponse.Minutes(),
+		"sla_resolution_minutes":     slaResolution.Minutes(),
+	})
+}
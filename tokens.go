@@ -0,0 +1,85 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Token signing keys
+type signingKeys struct {
+	// Active is the kid new tokens are signed with, the other keys only verify.
+	Active string
+	Keys   map[string][]byte
+}
+
+var tokenKeys signingKeys
+var tokenLifetime = time.Duration(envInt("ACCESS_TOKEN_MINUTES", 15)) * time.Minute
+
+var errNoSigningKey = errors.New("no token signing key")
+
+// parseSigningKeys parses a "kid:secret,kid:secret" list. The active kid
+// defaults to the last key, so rotating means appending a key and later
+// dropping the old one once its tokens have expired.
+func parseSigningKeys(value string, active string) (signingKeys, error) {
+	keys := signingKeys{Keys: map[string][]byte{}}
+	for _, pair := range strings.Split(value, ",") {
+		kid, secret, ok := strings.Cut(strings.TrimSpace(pair), ":")
+		if !ok || kid == "" || secret == "" {
+			return keys, errors.New("invalid signing key " + pair)
+		}
+		keys.Keys[kid] = []byte(secret)
+		keys.Active = kid
+	}
+	if active != "" {
+		if _, ok := keys.Keys[active]; !ok {
+			return keys, errors.New("unknown active signing key " + active)
+		}
+		keys.Active = active
+	}
+	return keys, nil
+}
+
+// loadSigningKeys reads JWT_KEYS and JWT_ACTIVE_KID, or a single JWT_SECRET.
+// Without configuration a random key is used, so tokens do not survive a restart.
+func loadSigningKeys() signingKeys {
+	if value := os.Getenv("JWT_KEYS"); value != "" {
+		keys, err := parseSigningKeys(value, os.Getenv("JWT_ACTIVE_KID"))
+		if err != nil {
+			logger.WithFields(logrus.Fields{
+				"action": "loadSigningKeys",
+				"status": "error",
+				"error":  err.Error(),
+			}).Fatal("Invalid JWT_KEYS")
+		}
+		return keys
+	}
+	if secret := os.Getenv("JWT_SECRET"); secret != "" {
+		return signingKeys{Active: "default", Keys: map[string][]byte{"default": []byte(secret)}}
+	}
+	logger.WithFields(logrus.Fields{
+		"action": "loadSigningKeys",
+		"status": "warning",
+	}).Warn("JWT_KEYS is not set, using a random signing key.")
+	kid := newTokenID()
+	return signingKeys{Active: kid, Keys: map[string][]byte{kid: []byte(newTokenID() + newTokenID())}}
+}
+func newTokenID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
+
+// hashSecret is how single use secrets like refresh, verification and reset tokens are stored.
+func hashSecret(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
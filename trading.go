@@ -0,0 +1,194 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Trading
+type Sale struct {
+	ID      string    `bson:"_id,omitempty" json:"id"`
+	Deal_id string    `json:"deal_id"`
+	Card_id int       `json:"card_id"`
+	Seller  string    `json:"seller"`
+	Buyer   string    `json:"buyer"`
+	Price   int       `json:"price"`
+	Fee     int       `json:"fee"`
+	Date    time.Time `json:"date"`
+}
+
+var errOwnListing = errors.New("you can not buy your own card")
+
+func listCard(w http.ResponseWriter, r *http.Request) {
+	userID, err := actingUserID(r, "user_id")
+	if err != nil {
+		sendForbidden(w, "listCard", err)
+		return
+	}
+	cardID, err := strconv.Atoi(r.URL.Query().Get("card_id"))
+	if err != nil {
+		sendErrorMessage(w, "listCard", err, "Invalid card_id parameter. Try again.")
+		return
+	}
+	price, err := strconv.Atoi(r.URL.Query().Get("price"))
+	if err != nil || price < 1 {
+		sendErrorMessage(w, "listCard", errors.New("invalid input"), "Invalid price. Price must be a positive number of coins.")
+		return
+	}
+	var deal Card_in_deal
+	var dealID string
+	err = withTransaction(r.Context(), func(sc mongo.SessionContext) error {
+		collection, err := getUserCollection(sc, userID)
+		if err != nil {
+			return err
+		}
+		rest, err := takeCards(collection.Card_id, map[int]int{cardID: 1})
+		if err != nil {
+			return err
+		}
+		for _, card := range collection.Card_id {
+			if card.Card_id == cardID {
+				deal.Card_id = card
+				break
+			}
+		}
+		_, err = db.Collection("collections").UpdateOne(sc, bson.M{"user_id": userID}, bson.M{"$set": bson.M{"card_id": rest}})
+		if err != nil {
+			return err
+		}
+		deal.User_id = userID
+		deal.Price = price
+		deal.Listed_at = time.Now()
+		deal.Expires_at = deal.Listed_at.Add(listingDuration)
+		result, err := db.Collection("cards_in_deal").InsertOne(sc, deal)
+		if err != nil {
+			return err
+		}
+		dealID = result.InsertedID.(primitive.ObjectID).Hex()
+		return chargeListingFee(sc, userID, dealID)
+	})
+	if err != nil {
+		sendErrorMessage(w, "listCard", err, "Error putting card on the market: "+err.Error()+".")
+		return
+	}
+	go matchPriceAlerts(context.Background(), Deals{
+		ID:         dealID,
+		User_id:    deal.User_id,
+		Card_id:    deal.Card_id,
+		Price:      deal.Price,
+		Listed_at:  deal.Listed_at,
+		Expires_at: deal.Expires_at,
+	})
+	sendSuccessMessage(w, "listCard", "The card "+deal.Card_id.Name+" was put on the market for "+strconv.Itoa(price)+" coins.", "")
+}
+func buyCard(w http.ResponseWriter, r *http.Request) {
+	userID, err := actingUserID(r, "user_id")
+	if err != nil {
+		sendForbidden(w, "buyCard", err)
+		return
+	}
+	dealID, err := primitive.ObjectIDFromHex(r.URL.Query().Get("deal_id"))
+	if err != nil {
+		sendErrorMessage(w, "buyCard", err, "Invalid deal_id parameter. Try again.")
+		return
+	}
+	var deal Deals
+	err = withTransaction(r.Context(), func(sc mongo.SessionContext) error {
+		err := db.Collection("cards_in_deal").FindOneAndDelete(sc, bson.M{"_id": dealID, "expires_at": bson.M{"$gt": time.Now()}}).Decode(&deal)
+		if err != nil {
+			return err
+		}
+		if deal.User_id == userID {
+			return errOwnListing
+		}
+		if err := changeCoins(sc, userID, -deal.Price, "buy:"+deal.ID); err != nil {
+			return err
+		}
+		schedule, err := feeScheduleAt(sc, time.Now())
+		if err != nil {
+			return err
+		}
+		fee := saleFee(deal.Price, schedule)
+		if err := changeCoins(sc, deal.User_id, deal.Price-fee, "sell:"+deal.ID); err != nil {
+			return err
+		}
+		if err := changeCoins(sc, systemAccount, fee, "sale_fee:"+deal.ID); err != nil {
+			return err
+		}
+		result, err := db.Collection("collections").UpdateOne(sc, bson.M{"user_id": userID}, bson.M{"$push": bson.M{"card_id": deal.Card_id}})
+		if err != nil {
+			return err
+		}
+		if result.MatchedCount == 0 {
+			return errors.New("buyer has no collection")
+		}
+		sale := Sale{
+			Deal_id: deal.ID,
+			Card_id: deal.Card_id.Card_id,
+			Seller:  deal.User_id,
+			Buyer:   userID,
+			Price:   deal.Price,
+			Fee:     fee,
+			Date:    time.Now(),
+		}
+		_, err = db.Collection("sales").InsertOne(sc, sale)
+		return err
+	})
+	if err == mongo.ErrNoDocuments {
+		sendErrorMessage(w, "buyCard", err, "The card is no longer on the market.")
+		return
+	}
+	if err == errOwnListing || err == errNotEnoughCoins {
+		sendErrorMessage(w, "buyCard", err, "Can not buy the card: "+err.Error()+".")
+		return
+	}
+	if err != nil {
+		sendErrorMessage(w, "buyCard", err, "Error buying the card. Try again.")
+		return
+	}
+	notifyUser(r.Context(), deal.User_id, notifyItemSold, "Your card "+deal.Card_id.Name+" was sold for "+strconv.Itoa(deal.Price)+" coins.", "/wallet")
+	receipt := map[string]interface{}{
+		"Card":    deal.Card_id.Name,
+		"Price":   deal.Price,
+		"Date":    time.Now().Format("02.01.2006 15:04"),
+		"Deal_id": deal.ID,
+	}
+	if err := sendUserTemplate(r.Context(), userID, "receipt", receipt); err != nil {
+		logger.WithFields(logrus.Fields{
+			"action": "buyCard",
+			"status": "error",
+			"error":  err.Error(),
+		}).Error("Error sending receipt")
+	}
+	sendSuccessMessage(w, "buyCard", "The card "+deal.Card_id.Name+" was bought for "+strconv.Itoa(deal.Price)+" coins.", "")
+}
+func cardSales(w http.ResponseWriter, r *http.Request) {
+	cardID, err := strconv.Atoi(r.URL.Query().Get("card_id"))
+	if err != nil {
+		sendErrorMessage(w, "cardSales", err, "Invalid card_id parameter. Try again.")
+		return
+	}
+	var sales []Sale
+	cursor, err := db.Collection("sales").Find(r.Context(), bson.M{"card_id": cardID}, options.Find().SetSort(bson.D{{Key: "date", Value: -1}}).SetLimit(50))
+	if err != nil {
+		sendErrorMessage(w, "cardSales", err, "Error getting sales. Try to reload page.")
+		return
+	}
+	if err := cursor.All(r.Context(), &sales); err != nil {
+		sendErrorMessage(w, "cardSales", err, "Error decoding sales. Try to reload page.")
+		return
+	}
+	respondWithJSON(w, http.StatusOK, map[string]interface{}{
+		"status": "success",
+		"sales":  sales,
+	})
+}
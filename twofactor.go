@@ -0,0 +1,402 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base32"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Two-factor authentication
+type TwoFactor struct {
+	User_id string `json:"user_id"`
+	Secret  string `json:"-"`
+	Enabled bool   `json:"enabled"`
+	// Recovery_codes holds the hashes of the unused recovery codes.
+	Recovery_codes []string `json:"-"`
+	// Last_step is the last accepted TOTP time step, a code is accepted only once.
+	Last_step  int64     `json:"-"`
+	Enabled_at time.Time `json:"enabled_at"`
+}
+type LoginChallenge struct {
+	ID         string    `bson:"_id"`
+	User_id    string    `json:"user_id"`
+	Attempts   int       `json:"attempts"`
+	Expires_at time.Time `json:"expires_at"`
+}
+type TwoFactorPolicy struct {
+	ID    string   `bson:"_id" json:"-"`
+	Roles []string `json:"roles"`
+	// Grace_until lets accounts of the roles in without two-factor
+	// authentication until then, so they can still enroll.
+	Grace_until time.Time `json:"grace_until"`
+}
+
+const (
+	totpIssuer          = "FootballManager"
+	totpPeriod          = 30
+	totpDigits          = 6
+	recoveryCodeCount   = 10
+	maxChallengeAttempt = 5
+	loginChallengeTTL   = 5 * time.Minute
+	twoFactorSettingsID = "two_factor"
+)
+
+// defaultTwoFactorRoles must pass two-factor authentication on an install
+// without a saved policy, after the TWO_FACTOR_GRACE_DAYS enrolment grace.
+var defaultTwoFactorRoles = []string{roleSupport, roleAdmin}
+var twoFactorGrace = time.Duration(envInt("TWO_FACTOR_GRACE_DAYS", 14)) * 24 * time.Hour
+
+var errInvalidCode = errors.New("invalid two-factor code")
+var errTwoFactorEnabled = errors.New("two-factor authentication is already enabled")
+var errTwoFactorRequired = errors.New("two-factor authentication is required for this role")
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+func newTOTPSecret() string {
+	b := make([]byte, 20)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return totpEncoding.EncodeToString(b)
+}
+
+// totpCode computes the RFC 6238 code of the time step.
+func totpCode(secret string, step int64) (string, error) {
+	key, err := totpEncoding.DecodeString(strings.ToUpper(secret))
+	if err != nil {
+		return "", err
+	}
+	msg := make([]byte, 8)
+	binary.BigEndian.PutUint64(msg, uint64(step))
+	mac := hmac.New(sha1.New, key)
+	mac.Write(msg)
+	sum := mac.Sum(nil)
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	return fmt.Sprintf("%0*d", totpDigits, value%1000000), nil
+}
+
+// verifyTOTP accepts the code of the current step and of one step either
+// side for clock drift, and returns the matching step.
+func verifyTOTP(secret string, code string, now time.Time) (int64, bool) {
+	step := now.Unix() / totpPeriod
+	for _, s := range []int64{step - 1, step, step + 1} {
+		expected, err := totpCode(secret, s)
+		if err == nil && hmac.Equal([]byte(expected), []byte(code)) {
+			return s, true
+		}
+	}
+	return 0, false
+}
+func totpURI(secret string, account string) string {
+	label := url.PathEscape(totpIssuer + ":" + account)
+	query := url.Values{
+		"secret":    {secret},
+		"issuer":    {totpIssuer},
+		"algorithm": {"SHA1"},
+		"digits":    {fmt.Sprint(totpDigits)},
+		"period":    {fmt.Sprint(totpPeriod)},
+	}
+	return "otpauth://totp/" + label + "?" + query.Encode()
+}
+
+// newRecoveryCodes returns the codes to show to the user and their hashes to store.
+func newRecoveryCodes() ([]string, []string) {
+	codes := make([]string, recoveryCodeCount)
+	hashes := make([]string, recoveryCodeCount)
+	for i := range codes {
+		id := newTokenID()
+		codes[i] = id[:5] + "-" + id[5:10]
+		hashes[i] = hashSecret(codes[i])
+	}
+	return codes, hashes
+}
+func twoFactorEnabled(ctx context.Context, userID string) (bool, error) {
+	count, err := db.Collection("two_factor").CountDocuments(ctx, bson.M{"user_id": userID, "enabled": true})
+	return count > 0, err
+}
+
+// verifySecondFactor checks a TOTP code or uses up a recovery code.
+func verifySecondFactor(ctx context.Context, userID string, code string) error {
+	var factor TwoFactor
+	err := db.Collection("two_factor").FindOne(ctx, bson.M{"user_id": userID, "enabled": true}).Decode(&factor)
+	if err == mongo.ErrNoDocuments {
+		return errInvalidCode
+	}
+	if err != nil {
+		return err
+	}
+	code = strings.TrimSpace(code)
+	if step, ok := verifyTOTP(factor.Secret, code, time.Now()); ok {
+		result, err := db.Collection("two_factor").UpdateOne(ctx, bson.M{"user_id": userID, "last_step": bson.M{"$lt": step}}, bson.M{"$set": bson.M{"last_step": step}})
+		if err != nil {
+			return err
+		}
+		if result.MatchedCount == 0 {
+			return errInvalidCode
+		}
+		return nil
+	}
+	result, err := db.Collection("two_factor").UpdateOne(ctx, bson.M{"user_id": userID, "recovery_codes": hashSecret(code)}, bson.M{"$pull": bson.M{"recovery_codes": hashSecret(code)}})
+	if err != nil {
+		return err
+	}
+	if result.MatchedCount == 0 {
+		return errInvalidCode
+	}
+	return nil
+}
+
+// startLoginChallenge remembers a correct password while the second factor is asked for.
+func startLoginChallenge(ctx context.Context, userID string) (string, error) {
+	token := newTokenID()
+	challenge := LoginChallenge{
+		ID:         hashSecret(token),
+		User_id:    userID,
+		Expires_at: time.Now().Add(loginChallengeTTL),
+	}
+	_, err := db.Collection("login_challenges").InsertOne(ctx, challenge)
+	return token, err
+}
+func twoFactorPolicy(ctx context.Context) (TwoFactorPolicy, error) {
+	policy := TwoFactorPolicy{ID: twoFactorSettingsID, Roles: defaultTwoFactorRoles}
+	err := db.Collection("settings").FindOne(ctx, bson.M{"_id": twoFactorSettingsID}).Decode(&policy)
+	if err == mongo.ErrNoDocuments {
+		return policy, nil
+	}
+	return policy, err
+}
+
+// ensureTwoFactorPolicy saves the default policy on first start, the grace
+// starts then so the support and admin accounts have time to enroll.
+func ensureTwoFactorPolicy(ctx context.Context) {
+	update := bson.M{"$setOnInsert": bson.M{"roles": defaultTwoFactorRoles, "grace_until": time.Now().Add(twoFactorGrace)}}
+	_, err := db.Collection("settings").UpdateOne(ctx, bson.M{"_id": twoFactorSettingsID}, update, options.Update().SetUpsert(true))
+	if err != nil {
+		logger.WithFields(logrus.Fields{
+			"action": "ensureTwoFactorPolicy",
+			"status": "error",
+			"error":  err.Error(),
+		}).Error("Error saving two-factor policy")
+	}
+}
+
+// covers tells whether the policy applies to one of the roles.
+func (policy TwoFactorPolicy) covers(userRoles []string) bool {
+	for _, role := range policy.Roles {
+		if hasRole(userRoles, role) {
+			return true
+		}
+	}
+	return false
+}
+
+// blocks tells whether a session of the roles is refused, it is once the
+// grace is over and the session did not pass two-factor authentication.
+func (policy TwoFactorPolicy) blocks(userRoles []string, mfa bool, now time.Time) bool {
+	return !mfa && policy.covers(userRoles) && !now.Before(policy.Grace_until)
+}
+
+func loginVerify(w http.ResponseWriter, r *http.Request) {
+	var data struct {
+		Challenge string `json:"challenge"`
+		Code      string `json:"code"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
+		sendErrorMessage(w, "loginVerify", err, "Error decoding login data. Try again.")
+		return
+	}
+	var challenge LoginChallenge
+	filter := bson.M{"_id": hashSecret(data.Challenge), "expires_at": bson.M{"$gt": time.Now()}, "attempts": bson.M{"$lt": maxChallengeAttempt}}
+	err := db.Collection("login_challenges").FindOneAndUpdate(r.Context(), filter, bson.M{"$inc": bson.M{"attempts": 1}}).Decode(&challenge)
+	if err != nil {
+		sendErrorMessage(w, "loginVerify", err, "Login expired. Log in again.")
+		return
+	}
+	var user User
+	if err := db.Collection("users").FindOne(r.Context(), bson.M{"user_id": challenge.User_id}).Decode(&user); err != nil {
+		sendErrorMessage(w, "loginVerify", err, "Login expired. Log in again.")
+		return
+	}
+	// wrong codes count as failed logins, so codes can not be guessed over many logins
+	ip := clientIP(r)
+	wait, err := loginWait(r.Context(), user.Email, ip)
+	if err != nil {
+		sendErrorMessage(w, "loginVerify", err, "Failed to log in. Try again.")
+		return
+	}
+	if wait > 0 {
+		sendErrorMessage(w, "loginVerify", errLoginLocked, "Too many failed attempts. Try again in "+strconv.Itoa(waitSeconds(wait))+" seconds.")
+		return
+	}
+	if err := verifySecondFactor(r.Context(), challenge.User_id, data.Code); err != nil {
+		if err := recordLoginFailure(r.Context(), user.Email, ip); err != nil {
+			sendErrorMessage(w, "loginVerify", err, "Failed to log in. Try again.")
+			return
+		}
+		sendErrorMessage(w, "loginVerify", err, "Incorrect code. Try again.")
+		return
+	}
+	db.Collection("login_challenges").DeleteOne(r.Context(), bson.M{"_id": challenge.ID})
+	finishLogin(w, r, &user, true)
+}
+func twoFactorStatus(w http.ResponseWriter, r *http.Request) {
+	identity, _ := identityFrom(r)
+	factor := TwoFactor{User_id: identity.User_id}
+	err := db.Collection("two_factor").FindOne(r.Context(), bson.M{"user_id": identity.User_id}).Decode(&factor)
+	if err != nil && err != mongo.ErrNoDocuments {
+		sendErrorMessage(w, "twoFactorStatus", err, "Error getting two-factor status. Try to reload page.")
+		return
+	}
+	policy, err := twoFactorPolicy(r.Context())
+	if err != nil {
+		sendErrorMessage(w, "twoFactorStatus", err, "Error getting two-factor policy. Try to reload page.")
+		return
+	}
+	respondWithJSON(w, http.StatusOK, map[string]interface{}{
+		"status":              "success",
+		"enabled":             factor.Enabled,
+		"required":            policy.covers(identity.Roles),
+		"grace_until":         policy.Grace_until,
+		"recovery_codes_left": len(factor.Recovery_codes),
+	})
+}
+func enrollTwoFactor(w http.ResponseWriter, r *http.Request) {
+	identity, _ := identityFrom(r)
+	var user User
+	if err := db.Collection("users").FindOne(r.Context(), bson.M{"user_id": identity.User_id}).Decode(&user); err != nil {
+		sendErrorMessage(w, "enrollTwoFactor", err, "User not found.")
+		return
+	}
+	secret := newTOTPSecret()
+	filter := bson.M{"user_id": identity.User_id, "enabled": bson.M{"$ne": true}}
+	update := bson.M{"$set": bson.M{"secret": secret, "enabled": false, "recovery_codes": bson.A{}, "last_step": 0}}
+	_, err := db.Collection("two_factor").UpdateOne(r.Context(), filter, update, options.Update().SetUpsert(true))
+	if mongo.IsDuplicateKeyError(err) {
+		sendErrorMessage(w, "enrollTwoFactor", errTwoFactorEnabled, "Two-factor authentication is already enabled.")
+		return
+	}
+	if err != nil {
+		sendErrorMessage(w, "enrollTwoFactor", err, "Error enabling two-factor authentication. Try again.")
+		return
+	}
+	respondWithJSON(w, http.StatusOK, map[string]interface{}{
+		"status": "success",
+		"secret": secret,
+		"uri":    totpURI(secret, user.Email),
+	})
+}
+func confirmTwoFactor(w http.ResponseWriter, r *http.Request) {
+	identity, _ := identityFrom(r)
+	var data struct {
+		Code string `json:"code"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
+		sendErrorMessage(w, "confirmTwoFactor", err, "Error decoding two-factor code. Try again.")
+		return
+	}
+	var factor TwoFactor
+	err := db.Collection("two_factor").FindOne(r.Context(), bson.M{"user_id": identity.User_id, "enabled": false}).Decode(&factor)
+	if err != nil {
+		sendErrorMessage(w, "confirmTwoFactor", err, "Start two-factor enrolment first.")
+		return
+	}
+	step, ok := verifyTOTP(factor.Secret, strings.TrimSpace(data.Code), time.Now())
+	if !ok {
+		sendErrorMessage(w, "confirmTwoFactor", errInvalidCode, "Incorrect code. Try again.")
+		return
+	}
+	codes, hashes := newRecoveryCodes()
+	update := bson.M{"$set": bson.M{"enabled": true, "recovery_codes": hashes, "last_step": step, "enabled_at": time.Now()}}
+	result, err := db.Collection("two_factor").UpdateOne(r.Context(), bson.M{"user_id": identity.User_id, "secret": factor.Secret, "enabled": false}, update)
+	if err != nil || result.MatchedCount == 0 {
+		if err == nil {
+			err = errTwoFactorEnabled
+		}
+		sendErrorMessage(w, "confirmTwoFactor", err, "Error enabling two-factor authentication. Try again.")
+		return
+	}
+	// the code was just checked, the current session counts as two-factor from its next refresh
+	db.Collection("sessions").UpdateOne(r.Context(), bson.M{"_id": identity.Session_id}, bson.M{"$set": bson.M{"mfa": true}})
+	respondWithJSON(w, http.StatusOK, map[string]interface{}{
+		"status":         "success",
+		"recovery_codes": codes,
+	})
+}
+func disableTwoFactor(w http.ResponseWriter, r *http.Request) {
+	identity, _ := identityFrom(r)
+	var data struct {
+		Code string `json:"code"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
+		sendErrorMessage(w, "disableTwoFactor", err, "Error decoding two-factor code. Try again.")
+		return
+	}
+	if err := verifySecondFactor(r.Context(), identity.User_id, data.Code); err != nil {
+		sendErrorMessage(w, "disableTwoFactor", err, "Incorrect code. Try again.")
+		return
+	}
+	_, err := db.Collection("two_factor").DeleteOne(r.Context(), bson.M{"user_id": identity.User_id})
+	if err != nil {
+		sendErrorMessage(w, "disableTwoFactor", err, "Error disabling two-factor authentication. Try again.")
+		return
+	}
+	db.Collection("sessions").UpdateMany(r.Context(), bson.M{"user_id": identity.User_id}, bson.M{"$set": bson.M{"mfa": false}})
+	sendSuccessMessage(w, "disableTwoFactor", "Two-factor authentication disabled.", "")
+}
+func getTwoFactorPolicy(w http.ResponseWriter, r *http.Request) {
+	policy, err := twoFactorPolicy(r.Context())
+	if err != nil {
+		sendErrorMessage(w, "getTwoFactorPolicy", err, "Error getting two-factor policy. Try to reload page.")
+		return
+	}
+	respondWithJSON(w, http.StatusOK, map[string]interface{}{
+		"status":      "success",
+		"roles":       policy.Roles,
+		"grace_until": policy.Grace_until,
+	})
+}
+func setTwoFactorPolicy(w http.ResponseWriter, r *http.Request) {
+	var policy TwoFactorPolicy
+	if err := json.NewDecoder(r.Body).Decode(&policy); err != nil {
+		sendErrorMessage(w, "setTwoFactorPolicy", err, "Error decoding two-factor policy. Try again.")
+		return
+	}
+	for _, role := range policy.Roles {
+		if !validRole(role) {
+			sendErrorMessage(w, "setTwoFactorPolicy", errors.New("invalid input"), "Invalid role "+role+".")
+			return
+		}
+	}
+	if policy.Roles == nil {
+		policy.Roles = []string{}
+	}
+	// the admin saving the policy must pass it, or the next request locks them out
+	identity, _ := identityFrom(r)
+	if policy.blocks(identity.Roles, identity.MFA, time.Now()) {
+		sendErrorMessage(w, "setTwoFactorPolicy", errTwoFactorRequired, "Enable two-factor authentication on your account before requiring it for your role.")
+		return
+	}
+	policy.ID = twoFactorSettingsID
+	_, err := db.Collection("settings").ReplaceOne(r.Context(), bson.M{"_id": twoFactorSettingsID}, policy, options.Replace().SetUpsert(true))
+	if err != nil {
+		sendErrorMessage(w, "setTwoFactorPolicy", err, "Error saving two-factor policy. Try again.")
+		return
+	}
+	sendSuccessMessage(w, "setTwoFactorPolicy", "Two-factor policy saved.", "")
+}
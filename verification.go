@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Email verification
+var verificationLifetime = time.Duration(envInt("VERIFICATION_TOKEN_HOURS", 24)) * time.Hour
+var verificationResendInterval = time.Duration(envInt("VERIFICATION_RESEND_SECONDS", 60)) * time.Second
+
+var errVerificationThrottled = errors.New("verification email was sent recently")
+
+// appURL is the public address used in emailed links.
+func appURL() string {
+	if value := os.Getenv("APP_URL"); value != "" {
+		return value
+	}
+	return "https://advprog1.onrender.com"
+}
+
+// storePendingUser saves a registration waiting for confirmation with a new
+// verification token and returns the token. With passwordHash empty only an
+// existing pending registration gets a new token. A new token is issued at
+// most once per verificationResendInterval.
+func storePendingUser(ctx context.Context, email string, passwordHash string, language string) (string, error) {
+	token := newTokenID()
+	now := time.Now()
+	filter := bson.M{
+		"email":     email,
+		"confirmed": bson.M{"$ne": true},
+		"$or": bson.A{
+			bson.M{"last_sent": bson.M{"$lte": now.Add(-verificationResendInterval)}},
+			bson.M{"last_sent": bson.M{"$exists": false}},
+		},
+	}
+	set := bson.M{
+		"token_hash": hashSecret(token),
+		"expires_at": now.Add(verificationLifetime),
+		"last_sent":  now,
+		"confirmed":  false,
+		"language":   language,
+	}
+	if passwordHash != "" {
+		set["password"] = passwordHash
+	}
+	result, err := db.Collection("confirm_users").UpdateOne(ctx, filter, bson.M{"$set": set}, options.Update().SetUpsert(passwordHash != ""))
+	if mongo.IsDuplicateKeyError(err) {
+		return "", errVerificationThrottled
+	}
+	if err != nil {
+		return "", err
+	}
+	if result.MatchedCount == 0 && result.UpsertedCount == 0 {
+		return "", mongo.ErrNoDocuments
+	}
+	return token, nil
+}
+func sendVerificationEmail(ctx context.Context, email string, language string, token string) error {
+	link := appURL() + "/confirmPage?token=" + url.QueryEscape(token)
+	return sendTemplate(ctx, email, language, "verification", map[string]interface{}{"Link": link})
+}
+
+// expireLegacyConfirmations drops pending registrations made before
+// verification tokens, their links can not be confirmed any more.
+func expireLegacyConfirmations(ctx context.Context) {
+	_, err := db.Collection("confirm_users").UpdateMany(ctx, bson.M{"expires_at": bson.M{"$exists": false}}, bson.M{"$set": bson.M{"expires_at": time.Now()}})
+	if err != nil {
+		logger.WithFields(logrus.Fields{
+			"action": "expireLegacyConfirmations",
+			"status": "error",
+			"error":  err.Error(),
+		}).Error("Error expiring old pending registrations")
+	}
+}
+func resendVerification(w http.ResponseWriter, r *http.Request) {
+	email := r.URL.Query().Get("email")
+	token, err := storePendingUser(r.Context(), email, "", requestLanguage(r))
+	// the answer does not tell whether the email is registered or throttled
+	message := "If the email is waiting for confirmation, a new confirmation link was sent."
+	if err == mongo.ErrNoDocuments {
+		sendSuccessMessage(w, "resendVerification", message, "")
+		return
+	}
+	if err != nil {
+		sendErrorMessage(w, "resendVerification", err, "Error sending confirmation email. Try again.")
+		return
+	}
+	if err := sendVerificationEmail(r.Context(), email, requestLanguage(r), token); err != nil {
+		sendErrorMessage(w, "resendVerification", err, "Error send message. Try again.")
+		return
+	}
+	sendSuccessMessage(w, "resendVerification", message, "")
+}
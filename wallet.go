@@ -0,0 +1,74 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Coins
+type Wallet struct {
+	User_id string `json:"user_id"`
+	Coins   int    `json:"coins"`
+}
+type LedgerEntry struct {
+	ID      string    `bson:"_id,omitempty" json:"id"`
+	User_id string    `json:"user_id"`
+	Amount  int       `json:"amount"`
+	Reason  string    `json:"reason"`
+	Date    time.Time `json:"date"`
+}
+
+var errNotEnoughCoins = errors.New("not enough coins")
+
+// changeCoins adds amount (negative to withdraw) to the users wallet and
+// writes a ledger entry. Pass a mongo.SessionContext to run it inside a transaction.
+func changeCoins(ctx context.Context, userID string, amount int, reason string) error {
+	if amount == 0 {
+		return nil
+	}
+	if amount > 0 {
+		_, err := db.Collection("wallets").UpdateOne(ctx, bson.M{"user_id": userID}, bson.M{"$inc": bson.M{"coins": amount}}, options.Update().SetUpsert(true))
+		if err != nil {
+			return err
+		}
+	} else {
+		result, err := db.Collection("wallets").UpdateOne(ctx, bson.M{"user_id": userID, "coins": bson.M{"$gte": -amount}}, bson.M{"$inc": bson.M{"coins": amount}})
+		if err != nil {
+			return err
+		}
+		if result.MatchedCount == 0 {
+			return errNotEnoughCoins
+		}
+	}
+	entry := LedgerEntry{
+		User_id: userID,
+		Amount:  amount,
+		Reason:  reason,
+		Date:    time.Now(),
+	}
+	_, err := db.Collection("ledger").InsertOne(ctx, entry)
+	return err
+}
+func getWallet(w http.ResponseWriter, r *http.Request) {
+	userID, err := actingUserID(r, "user_id")
+	if err != nil {
+		sendForbidden(w, "getWallet", err)
+		return
+	}
+	wallet := Wallet{User_id: userID}
+	err = db.Collection("wallets").FindOne(r.Context(), bson.M{"user_id": userID}).Decode(&wallet)
+	if err != nil && err != mongo.ErrNoDocuments {
+		sendErrorMessage(w, "getWallet", err, "Error getting wallet. Try to reload page.")
+		return
+	}
+	respondWithJSON(w, http.StatusOK, map[string]interface{}{
+		"status": "success",
+		"wallet": wallet,
+	})
+}
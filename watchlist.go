@@ -0,0 +1,214 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Watchlist
+type WatchItem struct {
+	ID           string    `bson:"_id,omitempty" json:"id"`
+	User_id      string    `json:"user_id"`
+	Card_id      int       `json:"card_id"`
+	Target_price int       `json:"target_price"`
+	Created_at   time.Time `json:"created_at"`
+}
+
+// priceAlertFilter selects the watchers of the card of the listing whose target
+// price is at or above the listing price, it narrows what priceAlertMatches checks.
+func priceAlertFilter(deal Deals) bson.M {
+	return bson.M{
+		"card_id":      deal.Card_id.Card_id,
+		"target_price": bson.M{"$gte": deal.Price},
+		"user_id":      bson.M{"$ne": deal.User_id},
+	}
+}
+
+// priceAlertMatches tells whether the watch item alerts of the listing, sellers
+// are not alerted of their own listing.
+func priceAlertMatches(item WatchItem, deal Deals) bool {
+	return item.Card_id == deal.Card_id.Card_id && item.Target_price >= deal.Price && item.User_id != deal.User_id
+}
+
+// alertWatchers notifies the watchers matching the listing and emails those of
+// them who want market alerts through m, with their unsubscribe link.
+func alertWatchers(deal Deals, items []WatchItem, users map[string]User, notify func(userID string, message string, link string), m Mailer) {
+	message := deal.Card_id.Name + " is on the market for " + strconv.Itoa(deal.Price) + " coins."
+	link := "/marketSearch?q=" + url.QueryEscape(deal.Card_id.Name)
+	for _, item := range items {
+		if !priceAlertMatches(item, deal) {
+			continue
+		}
+		notify(item.User_id, message, link)
+		user, ok := users[item.User_id]
+		if !ok || !wantsEmail(user, topicMarketAlerts) {
+			continue
+		}
+		unsubscribe, err := unsubscribeURL(user.User_id, topicMarketAlerts)
+		if err == nil {
+			data := map[string]interface{}{"Card": deal.Card_id.Name, "Price": deal.Price, "Link": appURL() + link, "Unsubscribe": unsubscribe}
+			var email Email
+			if email, err = renderEmail("price_alert", userLanguage(user), user.Email, data); err == nil {
+				err = m.Send(email)
+			}
+		}
+		if err != nil {
+			logger.WithFields(logrus.Fields{
+				"action": "matchPriceAlerts",
+				"status": "error",
+				"error":  err.Error(),
+			}).Error("Error sending price alert")
+		}
+	}
+}
+
+// matchPriceAlerts tells every user watching the card of a new or relisted listing.
+func matchPriceAlerts(ctx context.Context, deal Deals) {
+	var items []WatchItem
+	cursor, err := db.Collection("watchlists").Find(ctx, priceAlertFilter(deal))
+	if err == nil {
+		err = cursor.All(ctx, &items)
+	}
+	var list []User
+	if err == nil && len(items) > 0 {
+		userIDs := make([]string, len(items))
+		for i, item := range items {
+			userIDs[i] = item.User_id
+		}
+		cursor, err = db.Collection("users").Find(ctx, bson.M{"user_id": bson.M{"$in": userIDs}})
+		if err == nil {
+			err = cursor.All(ctx, &list)
+		}
+	}
+	if err != nil {
+		logger.WithFields(logrus.Fields{
+			"action": "matchPriceAlerts",
+			"status": "error",
+			"error":  err.Error(),
+		}).Error("Error matching price alerts")
+		return
+	}
+	users := make(map[string]User, len(list))
+	for _, user := range list {
+		users[user.User_id] = user
+	}
+	notify := func(userID string, message string, link string) {
+		notifyUser(ctx, userID, notifyPriceAlert, message, link)
+	}
+	alertWatchers(deal, items, users, notify, outboxMailer{ctx: ctx})
+}
+func watchlist(w http.ResponseWriter, r *http.Request) {
+	userID, err := actingUserID(r, "user_id")
+	if err != nil {
+		sendForbidden(w, "watchlist", err)
+		return
+	}
+	var items []WatchItem
+	cursor, err := db.Collection("watchlists").Find(r.Context(), bson.M{"user_id": userID}, options.Find().SetSort(bson.D{{Key: "created_at", Value: -1}}))
+	if err != nil {
+		sendErrorMessage(w, "watchlist", err, "Error getting watchlist. Try to reload page.")
+		return
+	}
+	if err := cursor.All(r.Context(), &items); err != nil {
+		sendErrorMessage(w, "watchlist", err, "Error decoding watchlist. Try to reload page.")
+		return
+	}
+	respondWithJSON(w, http.StatusOK, map[string]interface{}{
+		"status":    "success",
+		"watchlist": items,
+	})
+}
+func addWatch(w http.ResponseWriter, r *http.Request) {
+	userID, err := actingUserID(r, "user_id")
+	if err != nil {
+		sendForbidden(w, "addWatch", err)
+		return
+	}
+	var item WatchItem
+	err = json.NewDecoder(r.Body).Decode(&item)
+	if err != nil {
+		sendErrorMessage(w, "addWatch", err, "Error decoding watchlist data. Try again.")
+		return
+	}
+	item.ID = ""
+	item.User_id = userID
+	if item.Target_price < 1 {
+		sendErrorMessage(w, "addWatch", errors.New("invalid input"), "Invalid target price. Target price must be a positive number of coins.")
+		return
+	}
+	err = db.Collection("cards").FindOne(r.Context(), bson.M{"card_id": item.Card_id}).Err()
+	if err != nil {
+		sendErrorMessage(w, "addWatch", err, "Card not found. Try again.")
+		return
+	}
+	item.Created_at = time.Now()
+	filter := bson.M{"user_id": item.User_id, "card_id": item.Card_id}
+	update := bson.M{"$set": bson.M{"target_price": item.Target_price}, "$setOnInsert": bson.M{"created_at": item.Created_at}}
+	_, err = db.Collection("watchlists").UpdateOne(r.Context(), filter, update, options.Update().SetUpsert(true))
+	if err != nil {
+		sendErrorMessage(w, "addWatch", err, "Error adding card to watchlist. Try again.")
+		return
+	}
+	sendSuccessMessage(w, "addWatch", "Card added to your watchlist.", "")
+}
+func updateWatch(w http.ResponseWriter, r *http.Request) {
+	userID, err := actingUserID(r, "user_id")
+	if err != nil {
+		sendForbidden(w, "updateWatch", err)
+		return
+	}
+	objID, err := primitive.ObjectIDFromHex(r.URL.Query().Get("id"))
+	if err != nil {
+		sendErrorMessage(w, "updateWatch", err, "Invalid id parameter. Try again.")
+		return
+	}
+	targetPrice, err := strconv.Atoi(r.URL.Query().Get("target_price"))
+	if err != nil || targetPrice < 1 {
+		sendErrorMessage(w, "updateWatch", errors.New("invalid input"), "Invalid target price. Target price must be a positive number of coins.")
+		return
+	}
+	filter := bson.M{"_id": objID, "user_id": userID}
+	result, err := db.Collection("watchlists").UpdateOne(r.Context(), filter, bson.M{"$set": bson.M{"target_price": targetPrice}})
+	if err != nil {
+		sendErrorMessage(w, "updateWatch", err, "Error updating watchlist. Try again.")
+		return
+	}
+	if result.MatchedCount == 0 {
+		sendErrorMessage(w, "updateWatch", errors.New("not found"), "Watchlist entry not found.")
+		return
+	}
+	sendSuccessMessage(w, "updateWatch", "Target price updated.", "")
+}
+func deleteWatch(w http.ResponseWriter, r *http.Request) {
+	userID, err := actingUserID(r, "user_id")
+	if err != nil {
+		sendForbidden(w, "deleteWatch", err)
+		return
+	}
+	objID, err := primitive.ObjectIDFromHex(r.URL.Query().Get("id"))
+	if err != nil {
+		sendErrorMessage(w, "deleteWatch", err, "Invalid id parameter. Try again.")
+		return
+	}
+	filter := bson.M{"_id": objID, "user_id": userID}
+	result, err := db.Collection("watchlists").DeleteOne(r.Context(), filter)
+	if err != nil {
+		sendErrorMessage(w, "deleteWatch", err, "Error deleting watchlist entry. Try again.")
+		return
+	}
+	if result.DeletedCount == 0 {
+		sendErrorMessage(w, "deleteWatch", errors.New("not found"), "Watchlist entry not found.")
+		return
+	}
+	sendSuccessMessage(w, "deleteWatch", "Card removed from your watchlist.", "")
+}